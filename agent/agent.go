@@ -183,6 +183,8 @@ func NewAgent() (*Agent, error) {
 	}
 
 	hserver.RegisterLoginRoute(apiAuthBackend)
+	hserver.RegisterWhoAmIRoute(apiAuthBackend)
+	hserver.RegisterAuthBackendsRoute(apiAuthBackend)
 
 	if err := hserver.Listen(); err != nil {
 		return nil, err
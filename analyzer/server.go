@@ -44,6 +44,7 @@ import (
 	"github.com/skydive-project/skydive/packet_injector"
 	"github.com/skydive-project/skydive/probe"
 	"github.com/skydive-project/skydive/rbac"
+	rback8s "github.com/skydive-project/skydive/rbac/k8s"
 	"github.com/skydive-project/skydive/topology"
 	"github.com/skydive-project/skydive/topology/enhancers"
 	"github.com/skydive-project/skydive/topology/graph"
@@ -93,6 +94,7 @@ func (s *Server) GetStatus() interface{} {
 		Alerts:      types.ElectionStatus{IsMaster: s.alertServer.IsMaster()},
 		Captures:    types.ElectionStatus{IsMaster: s.onDemandClient.IsMaster()},
 		Probes:      s.probeBundle.ActiveProbes(),
+		Auth:        shttp.GetAuthBackendsStatus(),
 	}
 }
 
@@ -202,6 +204,18 @@ func NewServerFromConfig() (*Server, error) {
 		return nil, err
 	}
 
+	switch authorizer := config.GetString("rbac.authorizer"); authorizer {
+	case "policy":
+	case "kubernetes":
+		sar, err := rback8s.NewSubjectAccessReviewAuthorizerFromConfig()
+		if err != nil {
+			return nil, err
+		}
+		rbac.SetAuthorizer(sar)
+	default:
+		return nil, fmt.Errorf("Unknown RBAC authorizer %s", authorizer)
+	}
+
 	hserver, err := shttp.NewServerFromConfig(common.AnalyzerService)
 	if err != nil {
 		return nil, err
@@ -232,13 +246,12 @@ func NewServerFromConfig() (*Server, error) {
 	clusterAuthOptions := AnalyzerClusterAuthenticationOpts()
 
 	clusterAuthBackendName := config.GetString("analyzer.auth.cluster.backend")
-	clusterAuthBackend, err := shttp.NewAuthenticationBackendByName(clusterAuthBackendName)
+	// force admin user for the cluster backend to ensure that all the user connection through
+	// "cluster" endpoints will be admin
+	clusterAuthBackend, err := shttp.NewClusterAuthenticationBackendByName(clusterAuthBackendName, "admin")
 	if err != nil {
 		return nil, err
 	}
-	// force admin user for the cluster backend to ensure that all the user connection through
-	// "cluster" endpoints will be admin
-	clusterAuthBackend.SetDefaultUserRole("admin")
 
 	apiAuthBackendName := config.GetString("analyzer.auth.api.backend")
 	apiAuthBackend, err := shttp.NewAuthenticationBackendByName(apiAuthBackendName)
@@ -246,7 +259,13 @@ func NewServerFromConfig() (*Server, error) {
 		return nil, err
 	}
 
+	shttp.InitSessions(etcdClient.KeysAPI)
 	hserver.RegisterLoginRoute(apiAuthBackend)
+	hserver.RegisterWhoAmIRoute(apiAuthBackend)
+	hserver.RegisterAuthBackendsRoute(apiAuthBackend)
+
+	shttp.InitPersonalAccessTokens(etcdClient.KeysAPI)
+	hserver.RegisterPersonalAccessTokenRoutes(apiAuthBackend)
 
 	agentWSServer := shttp.NewWSStructServer(shttp.NewWSServer(hserver, "/ws/agent", clusterAuthBackend))
 	_, err = NewTopologyAgentEndpoint(agentWSServer, cached, g)
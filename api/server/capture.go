@@ -27,10 +27,12 @@ import (
 
 	"github.com/skydive-project/skydive/api/types"
 	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
 	"github.com/skydive-project/skydive/flow"
 	ge "github.com/skydive-project/skydive/gremlin/traversal"
 	shttp "github.com/skydive-project/skydive/http"
 	"github.com/skydive-project/skydive/logging"
+	"github.com/skydive-project/skydive/rbac"
 	"github.com/skydive-project/skydive/topology/graph"
 )
 
@@ -101,6 +103,30 @@ func (c *CaptureAPIHandler) Decorate(resource types.Resource) {
 	capture.PCAPSocket = pcapSocket
 }
 
+// Authorize checks that the user is allowed to use the probe types the
+// capture may run with and to capture raw packets. A capture without type
+// runs with the default probe type of each node, every default probe type
+// is then checked. These permissions refine the capture write permission,
+// they are only enforced when defined for the user.
+func (c *CaptureAPIHandler) Authorize(username string, r types.Resource) error {
+	capture := r.(*types.Capture)
+
+	actions := []string{capture.Type}
+	if capture.Type == "" {
+		actions = common.DefaultProbeTypes()
+	}
+	if capture.RawPacketLimit != 0 {
+		actions = append(actions, "rawpackets")
+	}
+
+	unrestricted := config.GetBool("rbac.unrestricted_capture_types")
+	if action, ok := rbac.EnforceAll(username, "capture", unrestricted, actions...); !ok {
+		return fmt.Errorf("Missing permission capture:%s", action)
+	}
+
+	return nil
+}
+
 // Create tests that resource GremlinQuery does not exists already
 func (c *CaptureAPIHandler) Create(r types.Resource) error {
 	capture := r.(*types.Capture)
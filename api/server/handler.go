@@ -50,6 +50,12 @@ type Handler interface {
 	AsyncWatch(f WatcherCallback) StoppableWatcher
 }
 
+// ResourceAuthorizer is implemented by the handlers checking the permissions
+// of the user depending on the content of the created resource
+type ResourceAuthorizer interface {
+	Authorize(username string, resource types.Resource) error
+}
+
 // ResourceHandler aims to creates new resource of an API
 type ResourceHandler interface {
 	Name() string
@@ -145,6 +145,13 @@ func (a *Server) RegisterAPIHandler(handler Handler, authBackend shttp.Authentic
 					return
 				}
 
+				if authorizer, ok := handler.(ResourceAuthorizer); ok {
+					if err := authorizer.Authorize(r.Username, resource); err != nil {
+						writeError(w, http.StatusForbidden, err)
+						return
+					}
+				}
+
 				if err := handler.Create(resource); err != nil {
 					writeError(w, http.StatusBadRequest, err)
 					return
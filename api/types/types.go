@@ -77,6 +77,7 @@ type AnalyzerStatus struct {
 	Alerts      ElectionStatus
 	Captures    ElectionStatus
 	Probes      []string
+	Auth        map[string]shttp.AuthBackendStatus
 }
 
 // Capture describes a capture API
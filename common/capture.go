@@ -24,6 +24,7 @@ package common
 
 import (
 	"fmt"
+	"sort"
 )
 
 // CaptureType describes a list of allowed and default captures probes
@@ -97,6 +98,21 @@ func CheckProbeCapabilities(probeType string, capability ProbeCapability) bool {
 	return false
 }
 
+// DefaultProbeTypes returns the probe types used by default by the node
+// types, the probe type of a capture without type depending on the node
+func DefaultProbeTypes() []string {
+	seen := make(map[string]bool)
+	var probeTypes []string
+	for _, c := range CaptureTypes {
+		if !seen[c.Default] {
+			seen[c.Default] = true
+			probeTypes = append(probeTypes, c.Default)
+		}
+	}
+	sort.Strings(probeTypes)
+	return probeTypes
+}
+
 // ProbeTypeForNode returns the appropriate probe type for the given node type
 // and capture type.
 func ProbeTypeForNode(nodeTYpe string, captureType string) (string, error) {
@@ -0,0 +1,51 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package common
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDefaultProbeTypes(t *testing.T) {
+	expected := []string{"afpacket", "dpdk", "ovsmirror", "ovssflow"}
+	if probeTypes := DefaultProbeTypes(); !reflect.DeepEqual(probeTypes, expected) {
+		t.Errorf("Expected default probe types %v, got %v", expected, probeTypes)
+	}
+
+	// every node type resolves an empty capture type to one of them
+	for nodeType := range CaptureTypes {
+		probeType, err := ProbeTypeForNode(nodeType, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		found := false
+		for _, t := range expected {
+			found = found || t == probeType
+		}
+		if !found {
+			t.Errorf("Default probe type %s of node type %s isn't checked", probeType, nodeType)
+		}
+	}
+}
@@ -120,6 +120,28 @@ func init() {
 
 	cfg.SetDefault("host_id", host)
 
+	cfg.SetDefault("http.auth.authorization_header", "Authorization")
+	cfg.SetDefault("http.auth.bearer_enabled", false)
+	cfg.SetDefault("http.auth.break_glass.enabled", false)
+	cfg.SetDefault("http.auth.break_glass.username", "breakglass")
+	cfg.SetDefault("http.auth.break_glass.role", "admin")
+	cfg.SetDefault("http.auth.break_glass.session_timeout", 900)
+	cfg.SetDefault("http.auth.compromised_passwords.enabled", false)
+	cfg.SetDefault("http.auth.cookie_enabled", true)
+	cfg.SetDefault("http.auth.cookie_normalization", false)
+	cfg.SetDefault("http.auth.events.buffer", 100)
+	cfg.SetDefault("http.auth.events.drop", "newest")
+	cfg.SetDefault("http.auth.login_nonce.enabled", false)
+	cfg.SetDefault("http.auth.login_nonce.ttl", 60)
+	cfg.SetDefault("http.auth.minimal_disclosure", false)
+	cfg.SetDefault("http.auth.permissions_cookie_strict", false)
+	cfg.SetDefault("http.auth.permissions_refresh", false)
+	cfg.SetDefault("http.auth.personal_tokens.enabled", false)
+	cfg.SetDefault("http.auth.personal_tokens.max_lifetime", 7776000)
+	cfg.SetDefault("http.auth.redacted_context_keys", []string{})
+	cfg.SetDefault("http.auth.session_lifetime", 0)
+	cfg.SetDefault("http.auth.token_conflict", "reject")
+	cfg.SetDefault("http.auth.total_timeout", 0)
 	cfg.SetDefault("http.rest.debug", false)
 	cfg.SetDefault("http.ws.ping_delay", 2)
 	cfg.SetDefault("http.ws.pong_timeout", 5)
@@ -148,7 +170,13 @@ func init() {
 	cfg.SetDefault("sflow.port_min", 6345)
 	cfg.SetDefault("sflow.port_max", 6355)
 
+	cfg.SetDefault("rbac.authorizer", "policy")
+	cfg.SetDefault("rbac.kubernetes.api_group", "skydive.network")
+	cfg.SetDefault("rbac.kubernetes.cache_ttl", 10)
+	cfg.SetDefault("rbac.kubernetes.group_prefix", "")
+	cfg.SetDefault("rbac.kubernetes.user_prefix", "")
 	cfg.SetDefault("rbac.model.request_definition", []string{"sub, obj, act"})
+	cfg.SetDefault("rbac.unrestricted_capture_types", false)
 	cfg.SetDefault("rbac.model.policy_definition", []string{"sub, obj, act, eft"})
 	cfg.SetDefault("rbac.model.role_definition", []string{"_, _"})
 	cfg.SetDefault("rbac.model.policy_effect", []string{"some(where (p_eft == allow)) && !some(where (p_eft == deny))"})
@@ -405,6 +433,11 @@ func GetInt(key string) int {
 	return cfg.GetInt(realKey(key))
 }
 
+// GetFloat64 returns a float from the configuration
+func GetFloat64(key string) float64 {
+	return cfg.GetFloat64(realKey(key))
+}
+
 // GetString returns a string from the configuration
 func GetString(key string) string {
 	return cfg.GetString(realKey(key))
@@ -415,6 +448,11 @@ func GetStringSlice(key string) []string {
 	return cfg.GetStringSlice(realKey(key))
 }
 
+// GetStringMap returns a map of interfaces from the configuration
+func GetStringMap(key string) map[string]interface{} {
+	return cfg.GetStringMap(realKey(key))
+}
+
 // GetStringMapString returns a map of strings from the configuration
 func GetStringMapString(key string) map[string]string {
 	return cfg.GetStringMapString(realKey(key))
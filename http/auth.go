@@ -24,28 +24,47 @@ package http
 
 import (
 	"bytes"
+	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"sort"
 	"strings"
+	"sync"
+	"time"
 
-	"github.com/gorilla/context"
+	gcontext "github.com/gorilla/context"
 
 	"github.com/abbot/go-http-auth"
 	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
 	"github.com/skydive-project/skydive/rbac"
 )
 
 var (
 	// ErrWrongCredentials error wrong credentials
 	ErrWrongCredentials = errors.New("Wrong credentials")
+	// ErrDuplicateCookies error multiple authentication cookies, none valid
+	ErrDuplicateCookies = errors.New("Multiple authentication cookies, none of them valid")
+	// ErrConflictingCredentials error cookie and bearer token of different users
+	ErrConflictingCredentials = errors.New("Conflicting authentication cookie and bearer token")
+	// ErrPasswordExpired error password expired past the grace period
+	ErrPasswordExpired = errors.New("Password expired")
+	// ErrAuthTimeout error authentication exceeding the total timeout
+	ErrAuthTimeout = errors.New("Authentication timeout")
 )
 
 const (
 	defaultUserRole = "admin"
 	tokenName       = "authtok"
+
+	permissionsVersionCookie = "permissions_version"
+	permissionsChangedHeader = "X-Permissions-Changed"
 )
 
 type AuthenticationOpts struct {
@@ -74,12 +93,42 @@ func SetAuthHeaders(headers *http.Header, authOpts *AuthenticationOpts) {
 		cookies = append(cookies, &http.Cookie{Name: name, Value: value})
 	}
 
-	var b bytes.Buffer
+	if cookie := serializeCookies(cookies); cookie != "" {
+		headers.Set("Cookie", cookie)
+	}
+}
+
+// serializeCookies returns the value of a Cookie request header for the given
+// cookies. The net/http client serialization is used so that the values are
+// sanitized and quoted when needed.
+func serializeCookies(cookies []*http.Cookie) string {
+	request := &http.Request{Header: make(http.Header)}
 	for _, cookie := range cookies {
-		b.WriteString(cookie.String())
-		b.WriteString("; ")
+		request.AddCookie(cookie)
 	}
-	headers.Set("Cookie", b.String())
+	return request.Header.Get("Cookie")
+}
+
+// AuthBackendCapabilities describes the features supported by a backend
+type AuthBackendCapabilities struct {
+	Login       bool
+	Revocation  bool
+	Refresh     bool
+	Enumeration bool
+	MFA         bool
+}
+
+// AuthBackendBranding describes how a backend is presented on the login page
+type AuthBackendBranding struct {
+	DisplayName string `json:",omitempty"`
+	LogoURL     string `json:",omitempty"`
+	Description string `json:",omitempty"`
+}
+
+// AuthBackendInfo describes a backend to the clients
+type AuthBackendInfo struct {
+	AuthBackendCapabilities
+	Branding *AuthBackendBranding `json:",omitempty"`
 }
 
 // AuthenticationBackend is the interface of a authentication backend
@@ -89,83 +138,818 @@ type AuthenticationBackend interface {
 	SetDefaultUserRole(role string)
 	Authenticate(username string, password string) (string, error)
 	Wrap(wrapped auth.AuthenticatedHandlerFunc) http.HandlerFunc
+	Capabilities() AuthBackendCapabilities
 }
 
-func setPermissionsCookie(w http.ResponseWriter, username string) {
-	jsonPerms, _ := json.Marshal(rbac.GetPermissionsForUser(username))
-	http.SetCookie(w, &http.Cookie{
-		Name:  "permissions",
-		Value: base64.StdEncoding.EncodeToString([]byte(jsonPerms)),
-		Path:  "/",
+// authBackends keeps the backends created from the configuration along with
+// their branding
+var authBackends = struct {
+	sync.RWMutex
+	backends  map[string]AuthenticationBackend
+	brandings map[string]*AuthBackendBranding
+}{backends: make(map[string]AuthenticationBackend), brandings: make(map[string]*AuthBackendBranding)}
+
+// registerAuthBackend keeps a backend created from the configuration, its
+// branding being read and validated once
+func registerAuthBackend(name string, backend AuthenticationBackend) {
+	branding := getAuthBackendBranding(name)
+
+	authBackends.Lock()
+	authBackends.backends[name] = backend
+	authBackends.brandings[name] = branding
+	authBackends.Unlock()
+}
+
+// GetAuthBackendsCapabilities returns the capabilities of the backends
+// created from the configuration
+func GetAuthBackendsCapabilities() map[string]AuthBackendCapabilities {
+	authBackends.RLock()
+	defer authBackends.RUnlock()
+
+	capabilities := make(map[string]AuthBackendCapabilities)
+	for name, backend := range authBackends.backends {
+		capabilities[name] = backend.Capabilities()
+	}
+	return capabilities
+}
+
+// getAuthBackendBranding returns the branding of a backend, nil if none is
+// defined. It is read once, when the backend is created. Only the branding keys are read so that nothing else of the
+// backend configuration can be exposed. Logos have to be served over HTTP(S)
+// or from the analyzer.
+func getAuthBackendBranding(name string) *AuthBackendBranding {
+	prefix := "auth." + name + ".branding."
+	branding := &AuthBackendBranding{
+		DisplayName: config.GetString(prefix + "display_name"),
+		LogoURL:     config.GetString(prefix + "logo_url"),
+		Description: config.GetString(prefix + "description"),
+	}
+
+	if branding.LogoURL != "" {
+		if u, err := url.Parse(branding.LogoURL); err != nil || (u.Scheme != "http" && u.Scheme != "https" && (u.Scheme != "" || u.Host != "")) {
+			logging.GetLogger().Errorf("Ignoring the logo URL %s of backend %s, only HTTP(S) URLs or local paths are allowed", branding.LogoURL, name)
+			branding.LogoURL = ""
+		}
+	}
+
+	if *branding == (AuthBackendBranding{}) {
+		return nil
+	}
+	return branding
+}
+
+// GetAuthBackendsBranding returns the branding of the backends created from
+// the configuration, the backends without branding being left out
+func GetAuthBackendsBranding() map[string]*AuthBackendBranding {
+	authBackends.RLock()
+	defer authBackends.RUnlock()
+
+	brandings := make(map[string]*AuthBackendBranding)
+	for name := range authBackends.backends {
+		if branding := authBackends.brandings[name]; branding != nil {
+			brandings[name] = branding
+		}
+	}
+	return brandings
+}
+
+// GetAuthBackendsInfo returns the capabilities and the branding of the
+// backends created from the configuration
+func GetAuthBackendsInfo() map[string]AuthBackendInfo {
+	authBackends.RLock()
+	defer authBackends.RUnlock()
+
+	infos := make(map[string]AuthBackendInfo)
+	for name, backend := range authBackends.backends {
+		infos[name] = AuthBackendInfo{
+			AuthBackendCapabilities: backend.Capabilities(),
+			Branding:                authBackends.brandings[name],
+		}
+	}
+	return infos
+}
+
+// cookieAuthEnabled returns whether the authentication token can be passed
+// and is issued through cookies
+func cookieAuthEnabled() bool {
+	return config.GetBool("http.auth.cookie_enabled")
+}
+
+// normalizeCookieHeader repairs the common malformations of a Cookie header:
+// commas or missing separators between the cookies and whitespaces around
+// the equal signs. Neither whitespaces nor commas are allowed in a cookie
+// value by RFC 6265, except in the quoted values which are kept as is.
+func normalizeCookieHeader(header string) string {
+	var pairs []string
+	var pair bytes.Buffer
+	flush := func() {
+		if pair.Len() > 0 {
+			pairs = append(pairs, pair.String())
+			pair.Reset()
+		}
+	}
+
+	quoted := false
+	for i := 0; i < len(header); i++ {
+		switch c := header[i]; {
+		case c == '"':
+			quoted = !quoted
+			pair.WriteByte(c)
+		case quoted:
+			pair.WriteByte(c)
+		case c == ';' || c == ',':
+			flush()
+		case c == ' ' || c == '\t':
+			j := i
+			for j+1 < len(header) && (header[j+1] == ' ' || header[j+1] == '\t') {
+				j++
+			}
+			// whitespaces around an equal sign are dropped, otherwise
+			// they separate two cookies
+			if b := pair.Bytes(); !(len(b) > 0 && b[len(b)-1] == '=') && !(j+1 < len(header) && header[j+1] == '=') {
+				flush()
+			}
+			i = j
+		default:
+			pair.WriteByte(c)
+		}
+	}
+	flush()
+
+	return strings.Join(pairs, "; ")
+}
+
+// normalizeRequestCookies rewrites the Cookie headers of a request in a
+// strict format if the normalization is enabled, so that a token isn't lost
+// because of a malformed header sent by a buggy proxy
+func normalizeRequestCookies(r *http.Request) {
+	if !config.GetBool("http.auth.cookie_normalization") || len(r.Header["Cookie"]) == 0 {
+		return
+	}
+
+	original := strings.Join(r.Header["Cookie"], "; ")
+	normalized := normalizeCookieHeader(original)
+	if normalized != original {
+		logging.GetLogger().Warningf("Malformed Cookie header repaired from %s", r.RemoteAddr)
+	}
+	r.Header["Cookie"] = []string{normalized}
+}
+
+// minimalDisclosure returns whether the roles and permissions of the users
+// are withheld from the clients, only a coarse access level being exposed.
+// RBAC is still fully enforced server side.
+func minimalDisclosure() bool {
+	return config.GetBool("http.auth.minimal_disclosure")
+}
+
+// disclosedPermissions returns the permissions of a user that can be exposed
+// to the clients
+func disclosedPermissions(username string) []rbac.Permission {
+	if minimalDisclosure() {
+		return nil
+	}
+	return rbac.GetPermissionsForUser(username)
+}
+
+// permissionsVersion returns a version identifying a set of permissions,
+// whatever their order
+func permissionsVersion(permissions []rbac.Permission) string {
+	sorted := append([]rbac.Permission{}, permissions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Object != sorted[j].Object {
+			return sorted[i].Object < sorted[j].Object
+		}
+		return sorted[i].Action < sorted[j].Action
 	})
+
+	jsonPerms, _ := json.Marshal(sorted)
+	digest := sha256.Sum256(jsonPerms)
+	return hex.EncodeToString(digest[:8])
+}
+
+func writePermissionsCookies(w http.ResponseWriter, permissions []rbac.Permission) {
+	jsonPerms, _ := json.Marshal(permissions)
+	cookies := []*http.Cookie{
+		{Name: "permissions", Value: base64.StdEncoding.EncodeToString([]byte(jsonPerms)), Path: "/"},
+		{Name: permissionsVersionCookie, Value: permissionsVersion(permissions), Path: "/"},
+	}
+
+	for _, cookie := range cookies {
+		// keep the permissions from being sent along cross-site requests,
+		// /whoami being the alternative for embedded UIs. The attribute is
+		// appended to the serialized cookie as net/http only supports it
+		// from Go 1.11.
+		if config.GetBool("http.auth.permissions_cookie_strict") {
+			w.Header().Add("Set-Cookie", cookie.String()+"; SameSite=Strict")
+			continue
+		}
+		http.SetCookie(w, cookie)
+	}
+}
+
+func setPermissionsCookie(w http.ResponseWriter, username string) {
+	if !cookieAuthEnabled() || minimalDisclosure() {
+		return
+	}
+
+	writePermissionsCookies(w, rbac.GetPermissionsForUser(username))
+}
+
+// permissionsCookiesSent returns whether the permissions cookies are already
+// part of the response
+func permissionsCookiesSent(w http.ResponseWriter) bool {
+	for _, cookie := range (&http.Response{Header: w.Header()}).Cookies() {
+		if cookie.Name == permissionsVersionCookie {
+			return true
+		}
+	}
+	return false
+}
+
+// refreshStalePermissions re-emits the permissions cookies when the version
+// presented by the client doesn't match the current permissions of the user,
+// the change being signaled to the UI with a header. The cookies are only
+// informational, the access decisions never rely on them.
+func refreshStalePermissions(w http.ResponseWriter, r *http.Request, username string) {
+	if !config.GetBool("http.auth.permissions_refresh") || !cookieAuthEnabled() || minimalDisclosure() {
+		return
+	}
+
+	// only the clients keeping the permissions cookie are concerned
+	if _, err := r.Cookie("permissions"); err != nil {
+		return
+	}
+
+	var version string
+	if cookie, err := r.Cookie(permissionsVersionCookie); err == nil {
+		version = cookie.Value
+	}
+
+	permissions := rbac.GetPermissionsForUser(username)
+	if version == permissionsVersion(permissions) {
+		return
+	}
+
+	logging.GetLogger().Debugf("Refreshing the stale permissions cookie of user %s", username)
+
+	// the cookies may already have been sent along a fresh authentication
+	if !permissionsCookiesSent(w) {
+		writePermissionsCookies(w, permissions)
+	}
+	w.Header().Set(permissionsChangedHeader, "true")
 }
 
 func authCallWrapped(w http.ResponseWriter, r *http.Request, username string, wrapped auth.AuthenticatedHandlerFunc) {
+	// refresh the session cookie, enforcing the idle timeout of the user roles
+	if cookie, err := r.Cookie(tokenName); err == nil && cookieAuthEnabled() {
+		if sessions == nil {
+			// the cookie Max-Age alone enforces the session lifetime
+			if sessionLifetime() <= 0 {
+				http.SetCookie(w, sessionCookie(cookie.Value, sessionTimeout(username)))
+			}
+		} else if timeout, ok := sessions.touch(cookie.Value, sessionTimeout(username)); ok {
+			http.SetCookie(w, sessionCookie(cookie.Value, timeout))
+		}
+	}
+
+	refreshStalePermissions(w, r, username)
+
 	ar := &auth.AuthenticatedRequest{Request: *r, Username: username}
 	copyRequestVars(r, &ar.Request)
 	wrapped(w, ar)
-	context.Clear(&ar.Request)
+	gcontext.Clear(&ar.Request)
+}
+
+// requestAuthenticator authenticates a request and returns the user name
+type requestAuthenticator func(w http.ResponseWriter, r *http.Request) (string, error)
+
+// headerWriter is a ResponseWriter only keeping the headers
+type headerWriter struct {
+	header http.Header
 }
 
-func authenticate(backend AuthenticationBackend, w http.ResponseWriter, username, password string) (string, error) {
+func (h *headerWriter) Header() http.Header {
+	return h.header
+}
+
+func (h *headerWriter) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (h *headerWriter) WriteHeader(status int) {
+}
+
+// authenticateWithTimeout runs the authentication of a request within the
+// total authentication timeout. The authentication runs on copies of the
+// request and of the response headers so that a late authentication can't
+// alter them once the timeout expired. The context of the copy expires with
+// the timeout so that a late authentication doesn't provision roles or open
+// sessions. The request to be used for the rest of the processing is
+// returned.
+func authenticateWithTimeout(w http.ResponseWriter, r *http.Request, authenticate requestAuthenticator) (string, *http.Request, error) {
+	timeout := time.Duration(config.GetInt("http.auth.total_timeout")) * time.Second
+	if timeout <= 0 {
+		username, err := authenticate(w, r)
+		return username, r, err
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+
+	rc := r.WithContext(ctx)
+	rc.Header = make(http.Header)
+	for k, v := range r.Header {
+		rc.Header[k] = append([]string{}, v...)
+	}
+	hw := &headerWriter{header: make(http.Header)}
+
+	type result struct {
+		username string
+		err      error
+	}
+	done := make(chan result, 1)
+	go func() {
+		username, err := authenticate(hw, rc)
+		done <- result{username: username, err: err}
+	}()
+
+	select {
+	case res := <-done:
+		for k, v := range hw.header {
+			w.Header()[k] = append(w.Header()[k], v...)
+		}
+		return res.username, rc.WithContext(r.Context()), res.err
+	case <-ctx.Done():
+		logging.GetLogger().Errorf("Authentication of request from %s exceeded %s", r.RemoteAddr, timeout)
+		return "", r, ErrAuthTimeout
+	}
+}
+
+// wrapAuthenticated returns a handler calling the wrapped handler once the
+// request authenticated, replying with the relevant error otherwise
+func wrapAuthenticated(backend AuthenticationBackend, authenticate requestAuthenticator, wrapped auth.AuthenticatedHandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		normalizeRequestCookies(r)
+
+		// the break-glass account doesn't depend on the backend
+		if username, ok := breakGlass.authenticateRequest(r); ok {
+			recordAuthentication(backend.Name(), authMethodBreakGlass, authOutcomeSuccess)
+			authCallWrapped(w, r, username, wrapped)
+			return
+		}
+
+		if username, ok, err := personalTokens.authenticateRequest(backend, r); ok {
+			recordAuthentication(backend.Name(), authMethodToken, authOutcome(err))
+			if err != nil {
+				unauthorized(w, r)
+				return
+			}
+			authCallWrapped(w, r, username, wrapped)
+			return
+		}
+
+		authorization := requestAuthorization(r)
+		method := requestAuthMethod(r)
+
+		username, r, err := authenticateWithTimeout(w, r, authenticate)
+		recordAuthentication(backend.Name(), method, authOutcome(err))
+
+		// the credentials passed in the headers are checked on every
+		// request, each check being notified like a login
+		if method == authMethodBasic || method == authMethodHMAC {
+			switch err {
+			case nil:
+				notifyAuthEvent(AuthEventLogin, username, backend, r)
+			case ErrPasswordExpired:
+				notifyAuthEvent(AuthEventLockout, headerUsername(authorization), backend, r)
+			case ErrBackendUnavailable, ErrAuthTimeout:
+			default:
+				notifyAuthEvent(AuthEventLoginFailure, headerUsername(authorization), backend, r)
+			}
+		}
+
+		switch err {
+		case nil:
+			authCallWrapped(w, r, username, wrapped)
+		case ErrBackendUnavailable:
+			backendUnavailable(w, r)
+		case ErrAuthTimeout:
+			authTimeout(w, r)
+		default:
+			setBearerChallenge(w, authorization)
+			unauthorized(w, r)
+		}
+	}
+}
+
+func authenticate(ctx context.Context, backend AuthenticationBackend, w http.ResponseWriter, username, password string) (string, error) {
+	token, _, err := authenticateSession(ctx, backend, w, username, password, false)
+	return token, err
+}
+
+// authenticateSession authenticates the user with the backend and sets the
+// authentication cookie when enabled. With a session store, a new session is
+// opened on every login, its random identifier being sent in the cookie in
+// place of the token issued by the backend and usable as a bearer token. The
+// clients passing their credentials in the headers send them on every
+// request, no session is opened for them. Nothing is provisioned once the
+// context expired. The token and the identifier of the session are returned.
+func authenticateSession(ctx context.Context, backend AuthenticationBackend, w http.ResponseWriter, username, password string, login bool) (string, string, error) {
+	if id, ok, err := breakGlass.login(w, username, password); ok {
+		if err == nil && ctx.Err() != nil {
+			sessions.end(id)
+			return "", "", ErrAuthTimeout
+		}
+		return "", id, err
+	}
+
 	token, err := backend.Authenticate(username, password)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 
-	if roles := rbac.GetUserRoles(username); len(roles) == 0 {
-		rbac.AddRoleForUser(username, backend.DefaultUserRole(username))
+	if ctx.Err() != nil {
+		return "", "", ErrAuthTimeout
 	}
 
+	provisionRole(backend, username)
+
+	var id string
 	if token != "" {
-		http.SetCookie(w, AuthCookie(token, "/"))
+		timeout := sessionTimeout(username)
+		if login && sessions != nil {
+			if id, timeout, err = sessions.start(backendSessionInfo(backend), token, timeout); err != nil {
+				return "", "", err
+			}
+			if ctx.Err() != nil {
+				sessions.end(id)
+				return "", "", ErrAuthTimeout
+			}
+			if cookieAuthEnabled() {
+				http.SetCookie(w, sessionCookie(id, timeout))
+			}
+		} else if cookieAuthEnabled() {
+			now := time.Now()
+			timeout = (&session{Issued: now, Timeout: timeout}).cookieTimeout(now, sessionLifetime())
+			http.SetCookie(w, sessionCookie(token, timeout))
+		}
 	}
 
 	setPermissionsCookie(w, username)
 
-	return token, nil
+	return token, id, nil
 }
 
-// Authenticate uses request and the given backend to authenticate
-func authenticateWithHeaders(backend AuthenticationBackend, w http.ResponseWriter, r *http.Request) (string, error) {
-	// first try to get an already retrieve auth token through cookie
-	cookie, err := r.Cookie(tokenName)
-	if err == nil {
-		http.SetCookie(w, AuthCookie(cookie.Value, "/"))
-		return cookie.Value, nil
+// bearerToken returns the token of a RFC 6750 bearer authorization header
+func bearerToken(authorization string) (string, bool) {
+	s := strings.SplitN(authorization, " ", 2)
+	if len(s) != 2 || !strings.EqualFold(s[0], "Bearer") || s[1] == "" {
+		return "", false
+	}
+	return s[1], true
+}
+
+// setBearerChallenge sets the RFC 6750 WWW-Authenticate header of a failed
+// authentication when bearer authentication is enabled. The error is only
+// reported when a token was presented in the authorization header.
+func setBearerChallenge(w http.ResponseWriter, authorization string) {
+	if !config.GetBool("http.auth.bearer_enabled") {
+		return
 	}
 
-	authorization := r.Header.Get("Authorization")
-	if authorization == "" {
+	challenge := fmt.Sprintf(`Bearer realm="%s"`, basicAuthRealm)
+	if _, ok := bearerToken(authorization); ok {
+		challenge += `, error="invalid_token", error_description="The access token is invalid or expired"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+}
+
+// tokenChecker is implemented by the backends able to validate a token
+type tokenChecker interface {
+	CheckUser(token string) (string, error)
+}
+
+// passwordExpiryChecker is implemented by the backends enforcing a maximum
+// password age
+type passwordExpiryChecker interface {
+	PasswordExpired(username string) bool
+}
+
+// tokenRevoker is implemented by the backends able to invalidate a token
+type tokenRevoker interface {
+	Revoke(token string) error
+}
+
+// credentialTokenIssuer is implemented by the backends whose tokens are the
+// credentials of the users, they are only accepted as bearer tokens through
+// a session
+type credentialTokenIssuer interface {
+	credentialToken()
+}
+
+// sessionToken returns the backend token of the session identified by the
+// value of an authentication cookie or of a bearer token. The value is the token of the backend
+// itself when it isn't a session, as set by the clients authenticating with
+// a token (see AuthenticationOpts) or without session store.
+func sessionToken(backend AuthenticationBackend, value string) (string, bool) {
+	if session, ok := sessions.lookup(backend.Name(), value); ok {
+		return session.token, true
+	}
+	return value, false
+}
+
+// cookieToken returns the token passed by cookie. Proxies can inject
+// additional authtok cookies, in that case the first valid one is used and
+// the other authtok cookies are removed from the request.
+func cookieToken(backend AuthenticationBackend, r *http.Request) (string, error) {
+	var ids []string
+	var others []*http.Cookie
+	for _, cookie := range r.Cookies() {
+		if cookie.Name == tokenName {
+			ids = append(ids, cookie.Value)
+		} else {
+			others = append(others, cookie)
+		}
+	}
+
+	switch len(ids) {
+	case 0:
 		return "", nil
+	case 1:
+		token, _ := sessionToken(backend, ids[0])
+		return token, nil
+	}
+
+	logging.GetLogger().Warningf("%d %s cookies received from %s, please check the proxy configuration", len(ids), tokenName, r.RemoteAddr)
+
+	checker, _ := backend.(tokenChecker)
+	for i, id := range ids {
+		token, ok := sessionToken(backend, id)
+		if checker != nil {
+			if user, err := checker.CheckUser(token); err != nil || user == "" {
+				continue
+			}
+		} else if !ok {
+			continue
+		}
+
+		logging.GetLogger().Warningf("Using %s cookie #%d of %d from %s", tokenName, i+1, len(ids), r.RemoteAddr)
+
+		r.Header.Set("Cookie", serializeCookies(append(others, AuthCookie(id, ""))))
+		return token, nil
+	}
+
+	logging.GetLogger().Errorf("None of the %d %s cookies received from %s is valid", len(ids), tokenName, r.RemoteAddr)
+	return "", ErrDuplicateCookies
+}
+
+// resolveTokenConflict picks the token to use when a request carries both an
+// authentication cookie and a different bearer token, according to the
+// http.auth.token_conflict policy. Tokens of different users are rejected by
+// the default "reject" policy.
+func resolveTokenConflict(backend AuthenticationBackend, r *http.Request, cookie, bearer string) (string, error) {
+	policy := config.GetString("http.auth.token_conflict")
+
+	checker, ok := backend.(tokenChecker)
+	if !ok {
+		if policy == "bearer" {
+			return bearer, nil
+		}
+		return cookie, nil
+	}
+
+	cookieUser, _ := checker.CheckUser(cookie)
+	bearerUser, _ := checker.CheckUser(bearer)
+	if cookieUser == "" || bearerUser == "" || cookieUser == bearerUser {
+		if policy == "bearer" || cookieUser == "" {
+			return bearer, nil
+		}
+		return cookie, nil
+	}
+
+	switch policy {
+	case "cookie":
+		logging.GetLogger().Warningf("Authentication cookie of user %s and bearer token of user %s from %s, using the cookie", cookieUser, bearerUser, r.RemoteAddr)
+		return cookie, nil
+	case "bearer":
+		logging.GetLogger().Warningf("Authentication cookie of user %s and bearer token of user %s from %s, using the bearer token", cookieUser, bearerUser, r.RemoteAddr)
+		return bearer, nil
+	default:
+		logging.GetLogger().Errorf("Authentication cookie of user %s and bearer token of user %s from %s, rejecting the request", cookieUser, bearerUser, r.RemoteAddr)
+		return "", ErrConflictingCredentials
+	}
+}
+
+// requestAuthorization returns the authorization material of a request. It
+// is read from the header set by http.auth.authorization_header, for the
+// proxies moving the Authorization header of the client to another header.
+func requestAuthorization(r *http.Request) string {
+	header := config.GetString("http.auth.authorization_header")
+	if header == "" {
+		header = "Authorization"
 	}
+	return r.Header.Get(header)
+}
 
+// headerUsername returns the user claimed by a Basic authorization, empty
+// for the other schemes
+func headerUsername(authorization string) string {
+	username, _, _ := basicCredentials(authorization)
+	return username
+}
+
+// basicCredentials returns the credentials of a Basic authorization
+func basicCredentials(authorization string) (username, password string, ok bool) {
 	s := strings.SplitN(authorization, " ", 2)
 	if len(s) != 2 || s[0] != "Basic" {
-		return "", ErrWrongCredentials
+		return
 	}
 
 	b, err := base64.StdEncoding.DecodeString(s[1])
 	if err != nil {
-		return "", ErrWrongCredentials
+		return
 	}
 	pair := strings.SplitN(string(b), ":", 2)
 	if len(pair) != 2 {
+		return
+	}
+	return pair[0], pair[1], true
+}
+
+// Authenticate uses request and the given backend to authenticate
+func authenticateWithHeaders(backend AuthenticationBackend, w http.ResponseWriter, r *http.Request) (string, error) {
+	authorization := requestAuthorization(r)
+	bearer, isBearer := bearerToken(authorization)
+	isBearer = isBearer && config.GetBool("http.auth.bearer_enabled")
+	if isBearer {
+		// the session identifiers are accepted as bearer tokens, the
+		// credentials only through a session
+		var session bool
+		if bearer, session = sessionToken(backend, bearer); !session {
+			if _, ok := backend.(credentialTokenIssuer); ok {
+				return "", ErrWrongCredentials
+			}
+		}
+	}
+
+	// first try to get an already retrieve auth token through cookie
+	if cookieAuthEnabled() {
+		token, err := cookieToken(backend, r)
+		if err != nil {
+			return "", err
+		}
+		if token != "" {
+			if isBearer && bearer != token {
+				return resolveTokenConflict(backend, r, token, bearer)
+			}
+			return token, nil
+		}
+	}
+
+	if authorization == "" {
+		return "", nil
+	}
+
+	if isBearer {
+		return bearer, nil
+	}
+
+	if !basicAllowedAddress(backend, r) {
 		return "", ErrWrongCredentials
 	}
-	username, password := pair[0], pair[1]
 
-	return authenticate(backend, w, username, password)
+	username, password, ok := basicCredentials(authorization)
+	if !ok {
+		return "", ErrWrongCredentials
+	}
+
+	return authenticate(r.Context(), backend, w, username, password)
+}
+
+// basicAllowedAddress returns whether the client of the request is in the
+// address ranges allowed to pass credentials to the backend
+func basicAllowedAddress(backend AuthenticationBackend, r *http.Request) bool {
+	cidrs := config.GetStringSlice("auth." + backend.Name() + ".basic_allowed_cidrs")
+	if len(cidrs) == 0 {
+		return true
+	}
+
+	if ip := clientIP(r); ip != nil && ipInCIDRs(ip, cidrs) {
+		return true
+	}
+
+	logging.GetLogger().Warningf("Credentials from %s rejected by the %s backend", r.RemoteAddr, backend.Name())
+	return false
+}
+
+// roleMapper is implemented by the backends granting other roles than their
+// default role
+type roleMapper interface {
+	mappedRoles() []string
+}
+
+// clusterBackends keeps the backends authenticating the analyzers and the
+// agents of the cluster, their default role is granted even if protected
+var clusterBackends = struct {
+	sync.RWMutex
+	backends map[AuthenticationBackend]bool
+}{backends: make(map[AuthenticationBackend]bool)}
+
+func isClusterBackend(backend AuthenticationBackend) bool {
+	clusterBackends.RLock()
+	defer clusterBackends.RUnlock()
+	return clusterBackends.backends[backend]
+}
+
+// provisionRole grants the default role of the backend to a user without
+// role. The protected roles are only granted by the cluster backends.
+func provisionRole(backend AuthenticationBackend, username string) {
+	if roles := rbac.GetUserRoles(username); len(roles) != 0 {
+		return
+	}
+
+	if role := backend.DefaultUserRole(username); isClusterBackend(backend) {
+		rbac.AddRoleForUser(username, role)
+	} else {
+		rbac.ProvisionRoleForUser(username, role)
+	}
+}
+
+// ValidateBackendRoles ensures that the roles granted by a backend are
+// defined in the RBAC policy, a user logged in with an unknown role would get
+// no access. The protected roles are refused as they are never granted
+// automatically, except the default role of the cluster backends. It has to
+// be called again when the default role of the backend is changed.
+func ValidateBackendRoles(backend AuthenticationBackend) error {
+	roles := []string{backend.DefaultUserRole("")}
+	if mapper, ok := backend.(roleMapper); ok {
+		roles = append(roles, mapper.mappedRoles()...)
+	}
+
+	cluster := isClusterBackend(backend)
+	for i, role := range roles {
+		if rbac.IsProtectedRole(role) && (i != 0 || !cluster) {
+			return fmt.Errorf("Role %s of authentication backend %s is protected, it can't be granted by a backend", role, backend.Name())
+		}
+		if !rbac.RoleExists(role) {
+			return fmt.Errorf("Role %s of authentication backend %s is not defined in the RBAC policy", role, backend.Name())
+		}
+	}
+	return nil
 }
 
 // NewAuthenticationBackendByName creates a new auth backend based on the name
-func NewAuthenticationBackendByName(name string) (backend AuthenticationBackend, err error) {
+func NewAuthenticationBackendByName(name string) (AuthenticationBackend, error) {
+	backend, err := newAuthenticationBackend(name)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = ValidateBackendRoles(backend); err != nil {
+		return nil, err
+	}
+
+	registerAuthBackend(name, backend)
+
+	return backend, nil
+}
+
+// NewClusterAuthenticationBackendByName creates the auth backend of the
+// analyzers and the agents of the cluster based on the name. The users
+// authenticated by the backend are granted the given role, even if
+// protected, in place of the role of the backend configuration.
+func NewClusterAuthenticationBackendByName(name string, role string) (AuthenticationBackend, error) {
+	backend, err := newAuthenticationBackend(name)
+	if err != nil {
+		return nil, err
+	}
+	backend.SetDefaultUserRole(role)
+
+	clusterBackends.Lock()
+	clusterBackends.backends[backend] = true
+	clusterBackends.Unlock()
+
+	if err = ValidateBackendRoles(backend); err != nil {
+		clusterBackends.Lock()
+		delete(clusterBackends.backends, backend)
+		clusterBackends.Unlock()
+		return nil, err
+	}
+
+	registerAuthBackend(name, backend)
+
+	return backend, nil
+}
+
+func newAuthenticationBackend(name string) (backend AuthenticationBackend, err error) {
 	typ := config.GetString("auth." + name + ".type")
 	switch typ {
 	case "basic":
 		backend, err = NewBasicAuthenticationBackendFromConfig(name)
 	case "keystone":
 		backend, err = NewKeystoneAuthenticationBackendFromConfig(name)
+	case "hmac":
+		backend, err = NewHMACAuthenticationBackendFromConfig(name)
 	case "noauth":
 		backend = NewNoAuthenticationBackend()
 	default:
@@ -0,0 +1,1149 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/abbot/go-http-auth"
+	etcd "github.com/coreos/etcd/client"
+	gcontext "github.com/gorilla/context"
+
+	"github.com/skydive-project/skydive/common"
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/rbac"
+)
+
+func TestSetAuthHeadersCookies(t *testing.T) {
+	config.Set("http.cookie", map[string]string{
+		"spaces": "a value with spaces",
+		"comma":  "a,b",
+		"semi":   "evil; injected=1",
+	})
+	defer config.Set("http.cookie", map[string]string{})
+
+	headers := make(http.Header)
+	SetAuthHeaders(&headers, &AuthenticationOpts{Token: "dG9rZW4="})
+
+	r := &http.Request{Header: headers}
+
+	expected := map[string]string{
+		tokenName: "dG9rZW4=",
+		"spaces":  "a value with spaces",
+		"comma":   "a,b",
+		"semi":    "evil injected=1",
+	}
+
+	cookies := r.Cookies()
+	if len(cookies) != len(expected) {
+		t.Fatalf("Expected %d cookies, got %d: %s", len(expected), len(cookies), headers.Get("Cookie"))
+	}
+
+	for _, cookie := range cookies {
+		value, ok := expected[cookie.Name]
+		if !ok {
+			t.Errorf("Unexpected cookie %s in header: %s", cookie.Name, headers.Get("Cookie"))
+			continue
+		}
+		if cookie.Value != value {
+			t.Errorf("Wrong value for cookie %s, expected '%s', got '%s'", cookie.Name, value, cookie.Value)
+		}
+	}
+}
+
+func TestSetAuthHeadersNoCookie(t *testing.T) {
+	headers := make(http.Header)
+	SetAuthHeaders(&headers, &AuthenticationOpts{Username: "user1", Password: "pass1"})
+
+	if cookie := headers.Get("Cookie"); cookie != "" {
+		t.Errorf("No cookie header expected, got: %s", cookie)
+	}
+
+	r := &http.Request{Header: headers}
+	if username, password, ok := r.BasicAuth(); !ok || username != "user1" || password != "pass1" {
+		t.Errorf("Wrong basic authentication header: %s", headers.Get("Authorization"))
+	}
+}
+
+func TestBearerChallenge(t *testing.T) {
+	defer useMemorySessions()()
+
+	config.Set("http.auth.bearer_enabled", true)
+	defer config.Set("http.auth.bearer_enabled", false)
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {})
+
+	// missing token, no error reported
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	handler(w, &http.Request{Header: make(http.Header)})
+
+	if w.status != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, w.status)
+	}
+	if challenge := w.headers.Get("WWW-Authenticate"); challenge != `Bearer realm="`+basicAuthRealm+`"` {
+		t.Errorf("Wrong challenge for a missing token: %s", challenge)
+	}
+
+	// invalid token
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	r := &http.Request{Header: make(http.Header)}
+	r.Header.Set("Authorization", "Bearer invalid")
+	handler(w, r)
+
+	if w.status != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d, got %d", http.StatusUnauthorized, w.status)
+	}
+	if challenge := w.headers.Get("WWW-Authenticate"); !strings.Contains(challenge, `error="invalid_token"`) {
+		t.Errorf("Wrong challenge for an invalid token: %s", challenge)
+	}
+
+	// credentials, only accepted through a session
+	var called bool
+	handler = basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) { called = true })
+
+	creds := base64.StdEncoding.EncodeToString([]byte("user1:pass1"))
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	r = &http.Request{Header: make(http.Header)}
+	r.Header.Set("Authorization", "Bearer "+creds)
+	handler(w, r)
+
+	if called || w.status != http.StatusUnauthorized {
+		t.Errorf("The credentials shouldn't be accepted as bearer token, got status %d", w.status)
+	}
+
+	// valid token
+	id, _, err := sessions.start(&SessionInfo{Backend: "basic"}, creds, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.end(id)
+
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	r = &http.Request{Header: make(http.Header)}
+	r.Header.Set("Authorization", "Bearer "+id)
+	handler(w, r)
+
+	if !called {
+		t.Error("The wrapped function should have been called with a valid bearer token")
+	}
+}
+
+func TestCookieAuthDisabled(t *testing.T) {
+	config.Set("http.auth.cookie_enabled", false)
+	defer config.Set("http.auth.cookie_enabled", true)
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var called bool
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) { called = true })
+
+	// credentials in the header, no cookie issued
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	r := &http.Request{Header: make(http.Header)}
+	r.SetBasicAuth("user1", "pass1")
+	handler(w, r)
+
+	if !called {
+		t.Fatal("The wrapped function should have been called")
+	}
+	if cookies := w.Header()["Set-Cookie"]; len(cookies) != 0 {
+		t.Errorf("No cookie should be issued, got: %v", cookies)
+	}
+
+	// authentication token in a cookie, ignored
+	called = false
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	r = &http.Request{Header: make(http.Header)}
+	r.AddCookie(AuthCookie(base64.StdEncoding.EncodeToString([]byte("user1:pass1")), "/"))
+	handler(w, r)
+
+	if called || w.status != http.StatusUnauthorized {
+		t.Error("Authentication token cookie should be ignored")
+	}
+}
+
+func TestAuthTimeout(t *testing.T) {
+	config.Set("http.auth.total_timeout", 1)
+	defer config.Set("http.auth.total_timeout", 0)
+
+	release := make(chan struct{})
+	defer close(release)
+
+	var called bool
+	handler := wrapAuthenticated(NewNoAuthenticationBackend(), func(w http.ResponseWriter, r *http.Request) (string, error) {
+		<-release
+		return "user1", nil
+	}, func(w http.ResponseWriter, r *auth.AuthenticatedRequest) { called = true })
+
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	start := time.Now()
+	handler(w, &http.Request{Header: make(http.Header)})
+
+	if called {
+		t.Error("The wrapped function shouldn't be called once the timeout expired")
+	}
+	if w.status != http.StatusGatewayTimeout {
+		t.Errorf("Expected status %d, got %d", http.StatusGatewayTimeout, w.status)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("Authentication should have been aborted after 1s, took %s", elapsed)
+	}
+}
+
+// slowAuthenticationBackend authenticates once released
+type slowAuthenticationBackend struct {
+	*BasicAuthenticationBackend
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (b *slowAuthenticationBackend) Authenticate(username string, password string) (string, error) {
+	<-b.release
+	defer close(b.done)
+	return b.BasicAuthenticationBackend.Authenticate(username, password)
+}
+
+func TestAuthTimeoutSideEffects(t *testing.T) {
+	config.Set("http.auth.total_timeout", 1)
+	defer config.Set("http.auth.total_timeout", 0)
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend := &slowAuthenticationBackend{BasicAuthenticationBackend: basic, release: make(chan struct{}), done: make(chan struct{})}
+
+	defer useMemorySessions()()
+
+	form := url.Values{"username": {"user1"}, "password": {"pass1"}}
+	r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	(&Server{}).serveLogin(w, r, backend)
+
+	if w.status != http.StatusGatewayTimeout {
+		t.Fatalf("Expected status %d, got %d", http.StatusGatewayTimeout, w.status)
+	}
+
+	close(backend.release)
+	<-backend.done
+	time.Sleep(100 * time.Millisecond)
+
+	if sessions.kapi.(*memoryKeysAPI).count() != 0 {
+		t.Error("No session should be opened by an authentication ending after the timeout")
+	}
+}
+
+func TestAuthResponsesNoStore(t *testing.T) {
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	checkNoStore := func(name string, w *fakeResponseWriter) {
+		if cc := w.headers.Get("Cache-Control"); cc != "no-store" {
+			t.Errorf("Wrong Cache-Control header for %s: %s", name, cc)
+		}
+		if pragma := w.headers.Get("Pragma"); pragma != "no-cache" {
+			t.Errorf("Wrong Pragma header for %s: %s", name, pragma)
+		}
+	}
+
+	s := &Server{}
+
+	form := url.Values{"username": {"user1"}, "password": {"pass1"}}
+	r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	s.serveLogin(w, r, basic)
+
+	if w.status != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.status)
+	}
+	checkNoStore("login", w)
+
+	r, _ = http.NewRequest("GET", "/whoami", nil)
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	s.serveWhoAmI(w, &auth.AuthenticatedRequest{Request: *r, Username: "user1"})
+	checkNoStore("whoami", w)
+
+	s.loginNonces = newNonceStore(time.Minute)
+	r, _ = http.NewRequest("GET", "/login/nonce", nil)
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	s.serveLoginNonce(w, r)
+	checkNoStore("login nonce", w)
+}
+
+func TestBearerCookieConflict(t *testing.T) {
+	defer useMemorySessions()()
+
+	config.Set("http.auth.bearer_enabled", true)
+	defer config.Set("http.auth.bearer_enabled", false)
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1", "user2": "pass2"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var username string
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) { username = r.Username })
+
+	cookie, _, err := sessions.start(&SessionInfo{Backend: "basic"}, base64.StdEncoding.EncodeToString([]byte("user1:pass1")), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.end(cookie)
+
+	bearer, _, err := sessions.start(&SessionInfo{Backend: "basic"}, base64.StdEncoding.EncodeToString([]byte("user2:pass2")), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.end(bearer)
+
+	request := func() *http.Request {
+		r := &http.Request{Header: make(http.Header)}
+		r.AddCookie(AuthCookie(cookie, "/"))
+		r.Header.Set("Authorization", "Bearer "+bearer)
+		return r
+	}
+
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	handler(w, request())
+	if username != "" || w.status != http.StatusUnauthorized {
+		t.Errorf("Conflicting credentials should be rejected, got user %s and status %d", username, w.status)
+	}
+
+	for policy, expected := range map[string]string{"cookie": "user1", "bearer": "user2"} {
+		config.Set("http.auth.token_conflict", policy)
+
+		username = ""
+		handler(&fakeResponseWriter{headers: make(http.Header)}, request())
+		if username != expected {
+			t.Errorf("Expected user %s with the %s policy, got %s", expected, policy, username)
+		}
+	}
+	config.Set("http.auth.token_conflict", "reject")
+}
+
+func TestLogout(t *testing.T) {
+	defer useMemorySessions()()
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	id, _, err := sessions.start(&SessionInfo{Backend: "basic"}, base64.StdEncoding.EncodeToString([]byte("user1:pass1")), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a cross-site request only carries the cookie
+	r, _ := http.NewRequest("POST", "/logout", nil)
+	r.AddCookie(AuthCookie(id, "/"))
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	(&Server{}).serveLogout(w, r, basic)
+
+	if w.status != http.StatusUnauthorized {
+		t.Fatalf("Expected status %d without the session in the Authorization header, got %d", http.StatusUnauthorized, w.status)
+	}
+	if _, ok := sessions.lookup("basic", id); !ok {
+		t.Fatal("The session shouldn't have been ended")
+	}
+
+	r.Header.Set("Authorization", "Bearer "+id)
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	(&Server{}).serveLogout(w, r, basic)
+
+	if w.status != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.status)
+	}
+	if _, ok := sessions.lookup("basic", id); ok {
+		t.Error("The session should have been ended")
+	}
+
+	cleared := make(map[string]bool)
+	for _, cookie := range (&http.Response{Header: w.headers}).Cookies() {
+		cleared[cookie.Name] = cookie.MaxAge < 0
+	}
+	for _, name := range []string{tokenName, "permissions"} {
+		if !cleared[name] {
+			t.Errorf("Cookie %s should have been cleared", name)
+		}
+	}
+
+	// the credentials aren't accepted outside of a session
+	for _, creds := range []string{"user1:pass1", "user1:wrong"} {
+		r, _ = http.NewRequest("POST", "/logout", nil)
+		r.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(creds)))
+		w = &fakeResponseWriter{headers: make(http.Header)}
+		(&Server{}).serveLogout(w, r, basic)
+		if w.status != http.StatusUnauthorized {
+			t.Errorf("Expected status %d for the credentials %s, got %d", http.StatusUnauthorized, creds, w.status)
+		}
+	}
+}
+
+func TestBasicAllowedCIDRs(t *testing.T) {
+	defer useMemorySessions()()
+
+	config.Set("auth.basic.basic_allowed_cidrs", []string{"10.0.0.0/8"})
+	config.Set("http.trusted_proxies", []string{"192.168.0.1"})
+	defer config.Set("auth.basic.basic_allowed_cidrs", []string{})
+	defer config.Set("http.trusted_proxies", []string{})
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var called bool
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) { called = true })
+
+	for _, test := range []struct {
+		remote    string
+		forwarded string
+		allowed   bool
+	}{
+		{"10.1.2.3:1234", "", true},
+		{"172.16.0.1:1234", "", false},
+		{"192.168.0.1:1234", "10.1.2.3", true},
+		{"192.168.0.1:1234", "172.16.0.1", false},
+		{"172.16.0.1:1234", "10.1.2.3", false},
+	} {
+		called = false
+		r := &http.Request{Header: make(http.Header), RemoteAddr: test.remote}
+		if test.forwarded != "" {
+			r.Header.Set("X-Forwarded-For", test.forwarded)
+		}
+		r.SetBasicAuth("user1", "pass1")
+		handler(&fakeResponseWriter{headers: make(http.Header)}, r)
+
+		if called != test.allowed {
+			t.Errorf("Basic authentication from %s forwarded for %q: expected allowed %v", test.remote, test.forwarded, test.allowed)
+		}
+	}
+
+	// the sessions are accepted from any address, the credentials only
+	// from the allowed ranges
+	config.Set("http.auth.bearer_enabled", true)
+	defer config.Set("http.auth.bearer_enabled", false)
+
+	creds := base64.StdEncoding.EncodeToString([]byte("user1:pass1"))
+	id, _, err := sessions.start(&SessionInfo{Backend: "basic"}, creds, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.end(id)
+
+	for _, remote := range []string{"10.1.2.3:1234", "172.16.0.1:1234"} {
+		allowed := remote == "10.1.2.3:1234"
+
+		called = false
+		r := &http.Request{Header: make(http.Header), RemoteAddr: remote}
+		r.AddCookie(AuthCookie(id, "/"))
+		handler(&fakeResponseWriter{headers: make(http.Header)}, r)
+		if !called {
+			t.Errorf("Session cookie from %s should be allowed", remote)
+		}
+
+		called = false
+		r = &http.Request{Header: make(http.Header), RemoteAddr: remote}
+		r.Header.Set("Authorization", "Bearer "+id)
+		handler(&fakeResponseWriter{headers: make(http.Header)}, r)
+		if !called {
+			t.Errorf("Bearer token from %s should be allowed", remote)
+		}
+
+		form := url.Values{"username": {"user1"}, "password": {"pass1"}}
+		r, _ = http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		r.RemoteAddr = remote
+		w := &fakeResponseWriter{headers: make(http.Header)}
+		(&Server{}).serveLogin(w, r, basic)
+		if (w.status == http.StatusOK) != allowed {
+			t.Errorf("Login from %s: expected allowed %v, got status %d", remote, allowed, w.status)
+		}
+	}
+}
+
+// emptyKeysAPI is an etcd without policy
+type emptyKeysAPI struct {
+	etcd.KeysAPI
+}
+
+func (k *emptyKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	return nil, errors.New("Key not found")
+}
+
+func (k *emptyKeysAPI) Watcher(key string, opts *etcd.WatcherOptions) etcd.Watcher {
+	return &emptyWatcher{}
+}
+
+type emptyWatcher struct{}
+
+func (w *emptyWatcher) Next(ctx context.Context) (*etcd.Response, error) {
+	return nil, errors.New("No change")
+}
+
+// allowAuthorizer grants every access
+type allowAuthorizer struct{}
+
+func (a allowAuthorizer) Authorize(user string, roles []string, obj, act string) (bool, error) {
+	return true, nil
+}
+
+func TestLoginPermissions(t *testing.T) {
+	// the bundled policy along with the configured one
+	if err := rbac.Init(&emptyKeysAPI{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the enforcer can't be removed, the other tests expect every access
+	// to be granted
+	defer rbac.SetAuthorizer(allowAuthorizer{})
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), "guest")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"username": {"user1"}, "password": {"pass1"}, "permissions": {"true"}}
+	r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	(&Server{}).serveLogin(w, r, basic)
+
+	if w.status != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.status)
+	}
+
+	var response LoginResponse
+	if err := json.Unmarshal(w.body, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	allowed := make(map[string]bool)
+	for _, permission := range response.Permissions {
+		allowed[permission.Object+":"+permission.Action] = permission.Allowed
+	}
+	if len(allowed) == 0 || !allowed["topology:read"] || allowed["capture:write"] {
+		t.Errorf("Expected the permissions of the guest role, got %+v", response.Permissions)
+	}
+
+	// a response is written even without any permission
+	provider = NewHtpasswdMapProvider(map[string]string{"user2": "pass2"})
+	if basic, err = NewBasicAuthenticationBackend("basic", provider.SecretProvider(), "norole"); err != nil {
+		t.Fatal(err)
+	}
+
+	form = url.Values{"username": {"user2"}, "password": {"pass2"}, "permissions": {"true"}}
+	r, _ = http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	(&Server{}).serveLogin(w, r, basic)
+
+	response = LoginResponse{}
+	if err := json.Unmarshal(w.body, &response); err != nil || len(response.Permissions) != 0 {
+		t.Errorf("Expected a response without permission, got %q: %v", w.body, err)
+	}
+}
+
+func TestLoginSessionFixation(t *testing.T) {
+	defer useMemorySessions()()
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(cookie string) string {
+		form := url.Values{"username": {"user1"}, "password": {"pass1"}}
+		r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if cookie != "" {
+			r.AddCookie(AuthCookie(cookie, "/"))
+		}
+		w := &fakeResponseWriter{headers: make(http.Header)}
+		(&Server{}).serveLogin(w, r, basic)
+
+		if w.status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.status)
+		}
+
+		for _, cookie := range (&http.Response{Header: w.headers}).Cookies() {
+			if cookie.Name == tokenName {
+				return cookie.Value
+			}
+		}
+		t.Fatal("A session cookie should be issued on login")
+		return ""
+	}
+
+	var called bool
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) { called = true })
+
+	authenticated := func(id string) bool {
+		called = false
+		r := &http.Request{Header: make(http.Header)}
+		r.AddCookie(AuthCookie(id, "/"))
+		w := &fakeResponseWriter{headers: make(http.Header)}
+		handler(w, r)
+		return called && w.status != http.StatusUnauthorized
+	}
+
+	// a session obtained by an attacker and set in the victim browser
+	fixed := login("")
+	if !authenticated(fixed) {
+		t.Fatal("The session issued on login should authenticate")
+	}
+
+	issued := login(fixed)
+	if issued == fixed {
+		t.Fatal("A new session should be issued on login")
+	}
+	if !authenticated(issued) {
+		t.Error("The new session should authenticate")
+	}
+	if authenticated(fixed) {
+		t.Error("The session set before the login should have been ended")
+	}
+
+	// the sessions are shared with the other analyzers through etcd
+	other := &sessionStore{kapi: sessions.kapi}
+	if _, ok := other.lookup("basic", issued); !ok {
+		t.Error("The new session should be known by the other analyzers")
+	}
+	if _, ok := other.lookup("basic", fixed); ok {
+		t.Error("The session set before the login should have been ended on the other analyzers")
+	}
+
+	// a session ended by another analyzer is rejected
+	other.end(issued)
+	if authenticated(issued) {
+		t.Error("The session ended by another analyzer shouldn't authenticate")
+	}
+}
+
+func TestAlternateAuthorizationHeader(t *testing.T) {
+	config.Set("http.auth.authorization_header", "X-Original-Authorization")
+	defer config.Set("http.auth.authorization_header", "Authorization")
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var username string
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) { username = r.Username })
+
+	r := &http.Request{Header: make(http.Header)}
+	r.Header.Set("Authorization", "Bearer proxy-token")
+	r.Header.Set("X-Original-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user1:pass1")))
+	handler(&fakeResponseWriter{headers: make(http.Header)}, r)
+
+	if username != "user1" {
+		t.Errorf("The credentials should be read from the alternate header, got user %q", username)
+	}
+
+	// validated as the standard header
+	username = ""
+	r = &http.Request{Header: make(http.Header)}
+	r.Header.Set("X-Original-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte("user1:wrong")))
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	handler(w, r)
+
+	if username != "" || w.status != http.StatusUnauthorized {
+		t.Errorf("Wrong credentials in the alternate header should be rejected, got status %d", w.status)
+	}
+}
+
+func TestJSONLogin(t *testing.T) {
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	login := func(body string) *fakeResponseWriter {
+		r, _ := http.NewRequest("POST", "/login", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json; charset=UTF-8")
+		w := &fakeResponseWriter{headers: make(http.Header)}
+		(&Server{}).serveLogin(w, r, basic)
+		return w
+	}
+
+	loginToken := func() string {
+		w := login(`{"Username": "user1", "Password": "pass1"}`)
+		if w.status != http.StatusOK {
+			t.Fatalf("Expected status %d, got %d", http.StatusOK, w.status)
+		}
+
+		var response LoginResponse
+		if err := json.Unmarshal(w.body, &response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Token
+	}
+
+	// the credentials held by the basic tokens are never returned
+	if token := loginToken(); token != "" {
+		t.Errorf("No token should be returned without session, got %q", token)
+	}
+
+	defer useMemorySessions()()
+
+	w := login(`{"Username": "user1", "Password": "pass1"}`)
+	var response LoginResponse
+	if err := json.Unmarshal(w.body, &response); err != nil {
+		t.Fatal(err)
+	}
+
+	var cookie string
+	for _, c := range (&http.Response{Header: w.headers}).Cookies() {
+		if c.Name == tokenName {
+			cookie = c.Value
+		}
+	}
+	if response.Token == "" || response.Token != cookie {
+		t.Errorf("The session should be returned in the body and as cookie, got %q and %q", response.Token, cookie)
+	}
+
+	// the session is usable as bearer token, even without cookies
+	config.Set("http.auth.cookie_enabled", false)
+	defer config.Set("http.auth.cookie_enabled", true)
+	config.Set("http.auth.bearer_enabled", true)
+	defer config.Set("http.auth.bearer_enabled", false)
+
+	token := loginToken()
+	if token == "" {
+		t.Fatal("The session should be returned without cookies")
+	}
+
+	r := &http.Request{Header: make(http.Header)}
+	r.Header.Set("Authorization", "Bearer "+token)
+	if user, err := basic.authenticateRequest(&fakeResponseWriter{headers: make(http.Header)}, r); err != nil || user != "user1" {
+		t.Errorf("The session should authenticate as bearer token, got %q: %v", user, err)
+	}
+
+	if w = login(`{"Username": "user1", "Password": "wrong"}`); w.status != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for wrong credentials, got %d", http.StatusUnauthorized, w.status)
+	}
+
+	if w = login(`{"Username": "user1"`); w.status != http.StatusBadRequest {
+		t.Errorf("Expected status %d for a malformed body, got %d", http.StatusBadRequest, w.status)
+	}
+
+	oversized := `{"Username": "user1", "Password": "` + strings.Repeat("a", maxLoginBodySize) + `"}`
+	if w = login(oversized); w.status != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected status %d for an oversized body, got %d", http.StatusRequestEntityTooLarge, w.status)
+	}
+}
+
+func TestCopyRequestVarsRedaction(t *testing.T) {
+	config.Set("http.auth.redacted_context_keys", []string{"X-Api-Key"})
+	defer config.Set("http.auth.redacted_context_keys", []string{})
+
+	type contextKey int
+
+	old := &http.Request{Header: make(http.Header)}
+	gcontext.Set(old, "Token", "secret-token")
+	gcontext.Set(old, "password", "pass1")
+	gcontext.Set(old, "x-api-key", "key")
+	gcontext.Set(old, "node", "node1")
+	gcontext.Set(old, contextKey(0), "vars")
+	defer gcontext.Clear(old)
+
+	new := &http.Request{Header: make(http.Header)}
+	copyRequestVars(old, new)
+	defer gcontext.Clear(new)
+
+	for _, key := range []string{"Token", "password", "x-api-key"} {
+		if _, ok := gcontext.GetOk(new, key); ok {
+			t.Errorf("Context key %s shouldn't be copied", key)
+		}
+	}
+
+	if v := gcontext.Get(new, "node"); v != "node1" {
+		t.Errorf("Context key node should be copied, got %v", v)
+	}
+	if v := gcontext.Get(new, contextKey(0)); v != "vars" {
+		t.Errorf("Non string context key should be copied, got %v", v)
+	}
+}
+
+func TestMinimalDisclosure(t *testing.T) {
+	config.Set("http.auth.minimal_disclosure", true)
+	defer config.Set("http.auth.minimal_disclosure", false)
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"username": {"user1"}, "password": {"pass1"}, "permissions": {"true"}}
+	r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	(&Server{}).serveLogin(w, r, basic)
+
+	if w.status != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.status)
+	}
+
+	for _, cookie := range (&http.Response{Header: w.headers}).Cookies() {
+		if cookie.Name == "permissions" {
+			t.Error("The permissions cookie shouldn't be set")
+		}
+	}
+
+	var response LoginResponse
+	if err := json.Unmarshal(w.body, &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Permissions != nil || response.AccessLevel == "" {
+		t.Errorf("Only the access level should be returned, got %+v", response)
+	}
+
+	r, _ = http.NewRequest("GET", "/whoami", nil)
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	(&Server{}).serveWhoAmI(w, &auth.AuthenticatedRequest{Request: *r, Username: "user1"})
+
+	var whoami WhoAmI
+	if err := json.Unmarshal(w.body, &whoami); err != nil {
+		t.Fatal(err)
+	}
+	if whoami.Roles != nil || whoami.Permissions != nil || whoami.AccessLevel == "" {
+		t.Errorf("Only the access level should be exposed, got %+v", whoami)
+	}
+}
+
+func TestCookieNormalization(t *testing.T) {
+	headers := []string{
+		"authtok = token1",
+		"lang=en, authtok=token1",
+		"lang=en authtok=token1",
+		"  lang=en ;authtok=token1;  ",
+	}
+
+	newRequest := func(header string) *http.Request {
+		r := &http.Request{Header: make(http.Header)}
+		r.Header.Set("Cookie", header)
+		return r
+	}
+
+	// malformed headers are left untouched by default
+	r := newRequest(headers[1])
+	normalizeRequestCookies(r)
+	if _, err := r.Cookie(tokenName); err == nil {
+		t.Error("The Cookie header shouldn't be normalized when disabled")
+	}
+
+	config.Set("http.auth.cookie_normalization", true)
+	defer config.Set("http.auth.cookie_normalization", false)
+
+	for _, header := range headers {
+		r := newRequest(header)
+		normalizeRequestCookies(r)
+
+		cookie, err := r.Cookie(tokenName)
+		if err != nil || cookie.Value != "token1" {
+			t.Errorf("Token not found in %q, normalized as %q", header, r.Header.Get("Cookie"))
+		}
+	}
+
+	// well formed headers, quoted values included, are kept as is
+	header := `lang=en; pref="a, b  = c"; ` + tokenName + `=token1`
+	r = newRequest(header)
+	cookies := r.Cookies()
+	normalizeRequestCookies(r)
+
+	if normalized := r.Header.Get("Cookie"); normalized != header {
+		t.Errorf("Well formed header %q normalized as %q", header, normalized)
+	}
+	if normalized := r.Cookies(); len(normalized) != len(cookies) {
+		t.Errorf("Expected cookies %v, got %v", cookies, normalized)
+	} else {
+		for i, cookie := range normalized {
+			if cookie.Name != cookies[i].Name || cookie.Value != cookies[i].Value {
+				t.Errorf("Expected cookie %v, got %v", cookies[i], cookie)
+			}
+		}
+	}
+}
+
+func TestAuthBackendBranding(t *testing.T) {
+	config.Set("auth.branded.branding.display_name", "Corporate accounts")
+	config.Set("auth.branded.branding.logo_url", "javascript:alert(1)")
+	defer config.Set("auth.branded.branding.display_name", "")
+	defer config.Set("auth.branded.branding.logo_url", "")
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("branded", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	registerAuthBackend("branded", basic)
+	defer func() {
+		authBackends.Lock()
+		delete(authBackends.backends, "branded")
+		delete(authBackends.brandings, "branded")
+		authBackends.Unlock()
+	}()
+
+	r, _ := http.NewRequest("GET", "/auth/backends", nil)
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	(&Server{}).serveAuthBackends(w, &auth.AuthenticatedRequest{Request: *r, Username: "user1"})
+
+	var infos map[string]map[string]interface{}
+	if err := json.Unmarshal(w.body, &infos); err != nil {
+		t.Fatal(err)
+	}
+
+	info := infos["branded"]
+	if login, _ := info["Login"].(bool); !login {
+		t.Errorf("The capabilities should be returned along with the branding, got %v", info)
+	}
+
+	branding, _ := info["Branding"].(map[string]interface{})
+	if branding["DisplayName"] != "Corporate accounts" {
+		t.Errorf("Wrong display name, got %v", branding)
+	}
+	if _, ok := branding["LogoURL"]; ok {
+		t.Errorf("A logo URL with a forbidden scheme shouldn't be exposed, got %v", branding)
+	}
+	if len(branding) != 1 {
+		t.Errorf("Only the branding keys should be exposed, got %v", branding)
+	}
+
+	// the branding alone is served without authentication
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	(&Server{}).serveAuthBranding(w, r)
+
+	var brandings map[string]map[string]interface{}
+	if err := json.Unmarshal(w.body, &brandings); err != nil {
+		t.Fatal(err)
+	}
+	if brandings["branded"]["DisplayName"] != "Corporate accounts" || len(brandings["branded"]) != 1 {
+		t.Errorf("Only the branding should be returned, got %v", brandings)
+	}
+}
+
+func TestStalePermissionsRefresh(t *testing.T) {
+	version := permissionsVersion(rbac.GetPermissionsForUser("user1"))
+
+	refresh := func(cookies ...*http.Cookie) *fakeResponseWriter {
+		r := &http.Request{Header: make(http.Header)}
+		for _, cookie := range cookies {
+			r.AddCookie(cookie)
+		}
+		w := &fakeResponseWriter{headers: make(http.Header)}
+		refreshStalePermissions(w, r, "user1")
+		return w
+	}
+
+	permissions := &http.Cookie{Name: "permissions", Value: "W10="}
+	stale := &http.Cookie{Name: permissionsVersionCookie, Value: "stale"}
+
+	if w := refresh(permissions, stale); w.headers.Get(permissionsChangedHeader) != "" {
+		t.Error("The permissions shouldn't be refreshed when disabled")
+	}
+
+	config.Set("http.auth.permissions_refresh", true)
+	defer config.Set("http.auth.permissions_refresh", false)
+
+	w := refresh(permissions, stale)
+	if w.headers.Get(permissionsChangedHeader) == "" {
+		t.Error("A stale permissions cookie should be signaled")
+	}
+
+	var refreshed string
+	for _, cookie := range (&http.Response{Header: w.headers}).Cookies() {
+		if cookie.Name == permissionsVersionCookie {
+			refreshed = cookie.Value
+		}
+	}
+	if refreshed != version {
+		t.Errorf("Expected permissions version %s, got %s", version, refreshed)
+	}
+
+	if w := refresh(permissions, &http.Cookie{Name: permissionsVersionCookie, Value: version}); len(w.headers) != 0 {
+		t.Errorf("Up to date permissions shouldn't be refreshed, got %v", w.headers)
+	}
+
+	if w := refresh(stale); len(w.headers) != 0 {
+		t.Errorf("Clients without permissions cookie shouldn't get one, got %v", w.headers)
+	}
+}
+
+func TestStalePermissionsRefreshOnce(t *testing.T) {
+	config.Set("http.auth.permissions_refresh", true)
+	defer config.Set("http.auth.permissions_refresh", false)
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := NewServer("myhost", common.AnalyzerService, "localhost", 59999, "")
+	s.HandleFunc("/refresh", func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {}, basic)
+
+	r, _ := http.NewRequest("GET", "/refresh", nil)
+	r.SetBasicAuth("user1", "pass1")
+	r.AddCookie(&http.Cookie{Name: "permissions", Value: "W10="})
+	r.AddCookie(&http.Cookie{Name: permissionsVersionCookie, Value: "stale"})
+
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	s.Router.ServeHTTP(w, r)
+
+	var count int
+	for _, cookie := range (&http.Response{Header: w.headers}).Cookies() {
+		if cookie.Name == "permissions" {
+			count++
+		}
+	}
+	if count != 1 {
+		t.Errorf("The permissions cookie should be sent once, got %d times", count)
+	}
+	if w.headers.Get(permissionsChangedHeader) == "" {
+		t.Error("A stale permissions cookie should be signaled")
+	}
+}
+
+func TestPermissionsCookieStrict(t *testing.T) {
+	permissions := []rbac.Permission{{Object: "capture", Action: "read", Allowed: true}}
+
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	writePermissionsCookies(w, permissions)
+	for _, cookie := range w.headers["Set-Cookie"] {
+		if strings.Contains(cookie, "SameSite") {
+			t.Errorf("SameSite shouldn't be set by default: %s", cookie)
+		}
+	}
+
+	config.Set("http.auth.permissions_cookie_strict", true)
+	defer config.Set("http.auth.permissions_cookie_strict", false)
+
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	writePermissionsCookies(w, permissions)
+
+	cookies := w.headers["Set-Cookie"]
+	if len(cookies) != 2 {
+		t.Fatalf("Expected 2 permissions cookies, got %v", cookies)
+	}
+	for _, cookie := range cookies {
+		if !strings.HasSuffix(cookie, "; SameSite=Strict") {
+			t.Errorf("SameSite=Strict should be set: %s", cookie)
+		}
+	}
+
+	// the cookies are still readable by the clients
+	if len((&http.Response{Header: w.headers}).Cookies()) != 2 {
+		t.Errorf("The permissions cookies should be parsable: %v", cookies)
+	}
+}
+
+func TestValidateBackendRoles(t *testing.T) {
+	config.Set("rbac.protected_roles", []string{"superadmin"})
+	defer config.Set("rbac.protected_roles", []string{})
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateBackendRoles(basic); err != nil {
+		t.Errorf("The default role should be accepted: %s", err)
+	}
+
+	basic.SetDefaultUserRole("superadmin")
+	if err := ValidateBackendRoles(basic); err == nil {
+		t.Error("A protected default role should be refused")
+	}
+
+	keys := map[string]HMACKey{"key1": {Secret: "secret1", Username: "user1", Role: "superadmin"}}
+	signed, err := NewHMACAuthenticationBackend("hmac", keys, defaultUserRole, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ValidateBackendRoles(signed); err == nil {
+		t.Error("A protected mapped role should be refused")
+	}
+}
+
+func TestClusterBackendProtectedRole(t *testing.T) {
+	config.Set("rbac.protected_roles", []string{"admin"})
+	defer config.Set("rbac.protected_roles", []string{})
+
+	config.Set("auth.cluster.type", "basic")
+	config.Set("auth.cluster.users", map[string]string{"analyzer": "secret"})
+	config.Set("auth.cluster.role", "admin")
+	defer config.Set("auth.cluster", map[string]interface{}{})
+
+	if _, err := NewAuthenticationBackendByName("cluster"); err == nil {
+		t.Error("A protected role of the configuration should be refused")
+	}
+
+	backend, err := NewClusterAuthenticationBackendByName("cluster", "admin")
+	if err != nil {
+		t.Fatalf("The forced role of the cluster backend should be accepted: %s", err)
+	}
+	defer func() {
+		authBackends.Lock()
+		delete(authBackends.backends, "cluster")
+		delete(authBackends.brandings, "cluster")
+		authBackends.Unlock()
+	}()
+	if err := ValidateBackendRoles(backend); err != nil {
+		t.Errorf("The forced role of the cluster backend should be accepted: %s", err)
+	}
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Authentication methods, the statistics being kept per backend, method and
+// outcome, all of them bounded, so that the number of counters stays small
+const (
+	authMethodBasic      = "basic"
+	authMethodBearer     = "bearer"
+	authMethodCookie     = "cookie"
+	authMethodHMAC       = "hmac"
+	authMethodToken      = "personal_token"
+	authMethodBreakGlass = "break_glass"
+	authMethodLogin      = "login"
+	authMethodNone       = "none"
+)
+
+// Outcomes of an authentication
+const (
+	authOutcomeSuccess     = "success"
+	authOutcomeFailure     = "failure"
+	authOutcomeUnavailable = "unavailable"
+	authOutcomeTimeout     = "timeout"
+)
+
+type authStatsKey struct {
+	backend string
+	method  string
+	outcome string
+}
+
+var authStats = struct {
+	sync.Mutex
+	counters map[authStatsKey]int64
+}{counters: make(map[authStatsKey]int64)}
+
+// recordAuthentication counts an authentication of a backend
+func recordAuthentication(backend, method, outcome string) {
+	authStats.Lock()
+	authStats.counters[authStatsKey{backend: backend, method: method, outcome: outcome}]++
+	authStats.Unlock()
+}
+
+// authOutcome returns the outcome of an authentication from its error
+func authOutcome(err error) string {
+	switch err {
+	case nil:
+		return authOutcomeSuccess
+	case ErrBackendUnavailable:
+		return authOutcomeUnavailable
+	case ErrAuthTimeout:
+		return authOutcomeTimeout
+	default:
+		return authOutcomeFailure
+	}
+}
+
+// requestAuthMethod returns the method used by a request to authenticate,
+// following the precedence of the backends: cookie, then the scheme of the
+// authorization header
+func requestAuthMethod(r *http.Request) string {
+	if cookie, err := r.Cookie(tokenName); err == nil && cookie.Value != "" && cookieAuthEnabled() {
+		return authMethodCookie
+	}
+
+	authorization := requestAuthorization(r)
+	switch {
+	case strings.HasPrefix(authorization, hmacAuthScheme+" "):
+		return authMethodHMAC
+	case authorization == "":
+		return authMethodNone
+	}
+	if _, ok := bearerToken(authorization); ok {
+		return authMethodBearer
+	}
+	if _, _, ok := basicCredentials(authorization); ok {
+		return authMethodBasic
+	}
+	return authMethodNone
+}
+
+// getAuthStats returns the authentication counters of each backend by
+// method then outcome. The counters only increase, the rates being computed
+// by the consumers between two reads.
+func getAuthStats() map[string]map[string]map[string]int64 {
+	authStats.Lock()
+	defer authStats.Unlock()
+
+	stats := make(map[string]map[string]map[string]int64)
+	for key, count := range authStats.counters {
+		methods, ok := stats[key.backend]
+		if !ok {
+			methods = make(map[string]map[string]int64)
+			stats[key.backend] = methods
+		}
+		outcomes, ok := methods[key.method]
+		if !ok {
+			outcomes = make(map[string]int64)
+			methods[key.method] = outcomes
+		}
+		outcomes[key.outcome] = count
+	}
+	return stats
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	auth "github.com/abbot/go-http-auth"
+)
+
+func TestAuthStats(t *testing.T) {
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("statsbasic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {})
+	call := func(authorization string) {
+		r := &http.Request{Header: make(http.Header)}
+		if authorization != "" {
+			r.Header.Set("Authorization", authorization)
+		}
+		handler(&fakeResponseWriter{headers: make(http.Header)}, r)
+	}
+
+	call("Basic " + base64.StdEncoding.EncodeToString([]byte("user1:pass1")))
+	call("Basic " + base64.StdEncoding.EncodeToString([]byte("user1:wrong")))
+	call("Basic " + base64.StdEncoding.EncodeToString([]byte("user1:wrong")))
+	call("")
+
+	form := url.Values{"username": {"user1"}, "password": {"pass1"}}
+	r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	(&Server{}).serveLogin(&fakeResponseWriter{headers: make(http.Header)}, r, basic)
+
+	stats := GetAuthBackendsStatus()["statsbasic"].Authentications
+
+	expected := map[string]map[string]int64{
+		authMethodBasic: {authOutcomeSuccess: 1, authOutcomeFailure: 2},
+		authMethodNone:  {authOutcomeFailure: 1},
+		authMethodLogin: {authOutcomeSuccess: 1},
+	}
+	for method, outcomes := range expected {
+		for outcome, count := range outcomes {
+			if stats[method][outcome] != count {
+				t.Errorf("Expected %d %s authentications with %s, got %d", count, outcome, method, stats[method][outcome])
+			}
+		}
+	}
+	if len(stats) != len(expected) {
+		t.Errorf("Unexpected authentication methods: %v", stats)
+	}
+}
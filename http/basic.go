@@ -25,11 +25,14 @@ package http
 import (
 	"encoding/base64"
 	"errors"
+	"fmt"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/abbot/go-http-auth"
 	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
 )
 
 const (
@@ -38,8 +41,11 @@ const (
 
 type BasicAuthenticationBackend struct {
 	*auth.BasicAuth
-	name string
-	role string
+	name           string
+	role           string
+	passwordSet    map[string]time.Time
+	passwordMaxAge time.Duration
+	passwordGrace  time.Duration
 }
 
 // Name returns the name of the backend
@@ -47,6 +53,16 @@ func (b *BasicAuthenticationBackend) Name() string {
 	return b.name
 }
 
+// Realm returns the realm of the basic authentication
+func (b *BasicAuthenticationBackend) Realm() string {
+	return basicAuthRealm
+}
+
+// Capabilities returns the features supported by the backend
+func (b *BasicAuthenticationBackend) Capabilities() AuthBackendCapabilities {
+	return AuthBackendCapabilities{Login: true}
+}
+
 // DefaultUserRole returns the default user role
 func (b *BasicAuthenticationBackend) DefaultUserRole(user string) string {
 	return b.role
@@ -57,36 +73,78 @@ func (b *BasicAuthenticationBackend) SetDefaultUserRole(role string) {
 	b.role = role
 }
 
+// PasswordExpired returns whether the password of a user is older than the
+// maximum password age. Users without password date are not concerned. The
+// expiry is advisory, the sessions of the user aren't restricted as the
+// passwords can't be changed through the API.
+func (b *BasicAuthenticationBackend) PasswordExpired(username string) bool {
+	set, ok := b.passwordSet[username]
+	return ok && b.passwordMaxAge > 0 && time.Since(set) > b.passwordMaxAge
+}
+
+// passwordLocked returns whether the grace period of an expired password is
+// over, a zero grace period meaning that expired passwords remain usable
+func (b *BasicAuthenticationBackend) passwordLocked(username string) bool {
+	if !b.PasswordExpired(username) || b.passwordGrace <= 0 {
+		return false
+	}
+	return time.Since(b.passwordSet[username]) > b.passwordMaxAge+b.passwordGrace
+}
+
+// checkAuth returns the user authenticated by the request, rejecting the
+// users whose password expired for longer than the grace period
+func (b *BasicAuthenticationBackend) checkAuth(r *http.Request) (string, error) {
+	username := b.CheckAuth(r)
+	if username == "" {
+		return "", ErrWrongCredentials
+	}
+
+	if b.passwordLocked(username) {
+		logging.GetLogger().Warningf("Password of user %s expired", username)
+		return "", ErrPasswordExpired
+	}
+
+	return username, nil
+}
+
 func (b *BasicAuthenticationBackend) Authenticate(username string, password string) (string, error) {
 	request := &http.Request{Header: make(http.Header)}
 	creds := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
 	request.Header.Set("Authorization", "Basic "+creds)
 
-	username = b.CheckAuth(request)
-	if username == "" {
-		return "", ErrWrongCredentials
+	if _, err := b.checkAuth(request); err != nil {
+		return "", err
 	}
 
 	return creds, nil
 }
 
-func (b *BasicAuthenticationBackend) Wrap(wrapped auth.AuthenticatedHandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		token, err := authenticateWithHeaders(b, w, r)
-		if err != nil {
-			unauthorized(w, r)
-			return
-		}
+// credentialToken marks the tokens of the backend as holding the credentials
+// of the users
+func (b *BasicAuthenticationBackend) credentialToken() {}
 
-		// add "fake" header to let the basic auth library do the authentication
-		r.Header.Set("Authorization", "Basic "+token)
+// CheckUser returns the user authenticated by the token
+func (b *BasicAuthenticationBackend) CheckUser(token string) (string, error) {
+	request := &http.Request{Header: make(http.Header)}
+	request.Header.Set("Authorization", "Basic "+token)
 
-		if username := b.CheckAuth(r); username == "" {
-			unauthorized(w, r)
-		} else {
-			authCallWrapped(w, r, username, wrapped)
-		}
+	return b.checkAuth(request)
+}
+
+func (b *BasicAuthenticationBackend) authenticateRequest(w http.ResponseWriter, r *http.Request) (string, error) {
+	token, err := authenticateWithHeaders(b, w, r)
+	if err != nil {
+		return "", err
 	}
+
+	// add "fake" header to let the basic auth library do the authentication
+	r.Header.Set("Authorization", "Basic "+token)
+
+	return b.checkAuth(r)
+}
+
+func (b *BasicAuthenticationBackend) Wrap(wrapped auth.AuthenticatedHandlerFunc) http.HandlerFunc {
+	return wrapAuthenticated(b, b.authenticateRequest, wrapped)
 }
 
 func NewBasicAuthenticationBackend(name string, provider auth.SecretProvider, role string) (*BasicAuthenticationBackend, error) {
@@ -116,5 +174,27 @@ func NewBasicAuthenticationBackendFromConfig(name string) (*BasicAuthenticationB
 		return nil, errors.New("No htpassword provider set, you set either file or inline sections")
 	}
 
-	return NewBasicAuthenticationBackend(name, provider, role)
+	backend, err := NewBasicAuthenticationBackend(name, provider, role)
+	if err != nil {
+		return nil, err
+	}
+
+	backend.passwordMaxAge = time.Duration(config.GetInt("auth."+name+".password_max_age")) * 24 * time.Hour
+	backend.passwordGrace = time.Duration(config.GetInt("auth."+name+".password_grace")) * 24 * time.Hour
+	backend.passwordSet = make(map[string]time.Time)
+	for user, date := range config.GetStringMapString("auth." + name + ".password_set") {
+		set, err := time.Parse("2006-01-02", date)
+		if err != nil {
+			if set, err = time.Parse(time.RFC3339, date); err != nil {
+				return nil, fmt.Errorf("Invalid password date for user %s: %s", user, date)
+			}
+		}
+		backend.passwordSet[user] = set
+	}
+
+	if backend.passwordMaxAge > 0 && backend.passwordGrace <= 0 {
+		logging.GetLogger().Warningf("No password grace period for %s backend, expired passwords remain usable", name)
+	}
+
+	return backend, nil
 }
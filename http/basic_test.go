@@ -23,8 +23,10 @@
 package http
 
 import (
+	"encoding/base64"
 	"net/http"
 	"testing"
+	"time"
 
 	auth "github.com/abbot/go-http-auth"
 )
@@ -100,3 +102,88 @@ func TestBasicAuthenticate(t *testing.T) {
 	// second check with authentication cookie
 	checkAuth(false)
 }
+
+func TestBasicDuplicateCookies(t *testing.T) {
+	defer useMemorySessions()()
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var called bool
+	var cookies []*http.Cookie
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+		called, cookies = true, r.Cookies()
+	})
+
+	// sessions of a valid and of a stale token
+	valid, _, err := sessions.start(&SessionInfo{Backend: "basic"}, base64.StdEncoding.EncodeToString([]byte("user1:pass1")), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.end(valid)
+
+	stale, _, err := sessions.start(&SessionInfo{Backend: "basic"}, base64.StdEncoding.EncodeToString([]byte("user1:stale")), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sessions.end(stale)
+
+	// stale cookie first, the valid one has to be used
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	r := &http.Request{Header: make(http.Header)}
+	r.AddCookie(AuthCookie(stale, ""))
+	r.AddCookie(AuthCookie(valid, ""))
+	handler(w, r)
+
+	if !called {
+		t.Fatal("The wrapped function should have been called with the valid cookie")
+	}
+
+	if len(cookies) != 1 || cookies[0].Value != valid {
+		t.Error("Only the valid authentication cookie should have been kept")
+	}
+
+	// only invalid cookies
+	called = false
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	r = &http.Request{Header: make(http.Header)}
+	r.AddCookie(AuthCookie(stale, ""))
+	r.AddCookie(AuthCookie(stale+"x", ""))
+	handler(w, r)
+
+	if called || w.status != http.StatusUnauthorized {
+		t.Error("Request with only invalid authentication cookies should be rejected")
+	}
+}
+
+func TestBasicPasswordExpiry(t *testing.T) {
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1", "user2": "pass2", "user3": "pass3"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	basic.passwordMaxAge = 90 * 24 * time.Hour
+	basic.passwordGrace = 10 * 24 * time.Hour
+	basic.passwordSet = map[string]time.Time{
+		"user1": time.Now().Add(-24 * time.Hour),
+		"user2": time.Now().Add(-95 * 24 * time.Hour),
+		"user3": time.Now().Add(-120 * 24 * time.Hour),
+	}
+
+	if _, err := basic.Authenticate("user1", "pass1"); err != nil || basic.PasswordExpired("user1") {
+		t.Errorf("Recent password should be valid: %v", err)
+	}
+
+	if _, err := basic.Authenticate("user2", "pass2"); err != nil || !basic.PasswordExpired("user2") {
+		t.Errorf("Expired password should be accepted and flagged during the grace period: %v", err)
+	}
+
+	if _, err := basic.Authenticate("user3", "pass3"); err != ErrPasswordExpired {
+		t.Errorf("Expected %s after the grace period, got %v", ErrPasswordExpired, err)
+	}
+}
@@ -0,0 +1,208 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"sync"
+	"time"
+
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
+)
+
+type circuitState int
+
+const (
+	circuitClosed circuitState = iota
+	circuitOpen
+	circuitHalfOpen
+)
+
+func (s circuitState) String() string {
+	switch s {
+	case circuitOpen:
+		return "open"
+	case circuitHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+// circuitBreaker stops calling a failing backend. The circuit opens when the
+// failure ratio over a window of calls reaches the threshold, the calls are
+// then rejected until the cooldown expires. A single probe call is then let
+// through, closing the circuit on success or opening it again on failure.
+type circuitBreaker struct {
+	sync.Mutex
+	name         string
+	window       int
+	failureRatio float64
+	cooldown     time.Duration
+	state        circuitState
+	calls        int
+	failures     int
+	openedAt     time.Time
+}
+
+func (c *circuitBreaker) open(now time.Time) {
+	c.state = circuitOpen
+	c.openedAt = now
+	c.calls, c.failures = 0, 0
+}
+
+// allow returns whether a call can be done
+func (c *circuitBreaker) allow() bool {
+	c.Lock()
+	defer c.Unlock()
+
+	switch c.state {
+	case circuitOpen:
+		if time.Since(c.openedAt) < c.cooldown {
+			return false
+		}
+		logging.GetLogger().Infof("Probing %s authentication backend, circuit half-open", c.name)
+		c.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		// a probe is already in progress
+		return false
+	}
+	return true
+}
+
+// report records the outcome of a call
+func (c *circuitBreaker) report(failure bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	if c.state == circuitHalfOpen {
+		if failure {
+			logging.GetLogger().Errorf("Probe of %s authentication backend failed, circuit open", c.name)
+			c.open(now)
+		} else {
+			logging.GetLogger().Infof("Probe of %s authentication backend succeeded, circuit closed", c.name)
+			c.state = circuitClosed
+			c.calls, c.failures = 0, 0
+		}
+		return
+	}
+
+	c.calls++
+	if failure {
+		c.failures++
+	}
+
+	if c.calls >= c.window {
+		if float64(c.failures)/float64(c.calls) >= c.failureRatio {
+			logging.GetLogger().Errorf("%d failures over %d calls to %s authentication backend, circuit open for %s", c.failures, c.calls, c.name, c.cooldown)
+			c.open(now)
+		} else {
+			c.calls, c.failures = 0, 0
+		}
+	}
+}
+
+// release ends a probe without outcome, the next call being let through as
+// a new probe
+func (c *circuitBreaker) release() {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.state == circuitHalfOpen {
+		c.state = circuitOpen
+	}
+}
+
+// do calls fn if the circuit allows it, isFailure telling whether an error
+// denotes a failing backend rather than rejected credentials. A call rejected
+// by the rate limiter or which panicked has no outcome. A nil circuit
+// breaker always calls fn.
+func (c *circuitBreaker) do(fn func() error, isFailure func(error) bool) error {
+	if c == nil {
+		return fn()
+	}
+
+	if !c.allow() {
+		return ErrBackendUnavailable
+	}
+
+	reported := false
+	defer func() {
+		if !reported {
+			c.release()
+		}
+	}()
+
+	err := fn()
+	if err == ErrBackendUnavailable {
+		return err
+	}
+
+	reported = true
+	c.report(err != nil && isFailure(err))
+
+	return err
+}
+
+func (c *circuitBreaker) status(status *AuthBackendStatus) {
+	if c == nil {
+		return
+	}
+
+	c.Lock()
+	status.Circuit = c.state.String()
+	c.Unlock()
+}
+
+func newCircuitBreaker(name string, window int, failureRatio float64, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		name:         name,
+		window:       window,
+		failureRatio: failureRatio,
+		cooldown:     cooldown,
+	}
+}
+
+// newCircuitBreakerFromConfig returns the circuit breaker of the outbound
+// calls of a backend, nil if not configured
+func newCircuitBreakerFromConfig(name string) *circuitBreaker {
+	prefix := "auth." + name + ".circuit_breaker"
+
+	failureRatio := config.GetFloat64(prefix + ".failure_ratio")
+	if failureRatio <= 0 {
+		return nil
+	}
+
+	window := 10
+	if config.IsSet(prefix + ".window") {
+		window = config.GetInt(prefix + ".window")
+	}
+
+	cooldown := 30
+	if config.IsSet(prefix + ".cooldown") {
+		cooldown = config.GetInt(prefix + ".cooldown")
+	}
+
+	return newCircuitBreaker(name, window, failureRatio, time.Duration(cooldown)*time.Second)
+}
@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	breaker := newCircuitBreaker("keystone", 4, 0.5, 50*time.Millisecond)
+
+	errDown := errors.New("connection refused")
+	isFailure := func(err error) bool { return err != ErrWrongCredentials }
+
+	failing := func() error { return errDown }
+	working := func() error { return nil }
+	rejecting := func() error { return ErrWrongCredentials }
+
+	// rejected credentials are not failures
+	for i := 0; i != 4; i++ {
+		breaker.do(rejecting, isFailure)
+	}
+	if breaker.state != circuitClosed {
+		t.Fatal("Rejected credentials should not open the circuit")
+	}
+
+	breaker.do(working, isFailure)
+	breaker.do(working, isFailure)
+	breaker.do(failing, isFailure)
+	breaker.do(failing, isFailure)
+	if breaker.state != circuitOpen {
+		t.Fatal("Circuit should be open")
+	}
+
+	called := false
+	if err := breaker.do(func() error { called = true; return nil }, isFailure); err != ErrBackendUnavailable || called {
+		t.Fatal("Calls should be short-circuited while the circuit is open")
+	}
+
+	// failed probe
+	time.Sleep(100 * time.Millisecond)
+	if err := breaker.do(failing, isFailure); err != errDown {
+		t.Fatalf("Probe should have been called, got: %v", err)
+	}
+	if breaker.state != circuitOpen {
+		t.Fatal("Circuit should be open again after a failed probe")
+	}
+
+	// successful probe
+	time.Sleep(100 * time.Millisecond)
+	if err := breaker.do(working, isFailure); err != nil {
+		t.Fatalf("Probe should have been called, got: %v", err)
+	}
+
+	var status AuthBackendStatus
+	if breaker.status(&status); status.Circuit != "closed" {
+		t.Fatalf("Circuit should be closed after a successful probe, got %s", status.Circuit)
+	}
+}
+
+func TestCircuitBreakerProbeWithoutOutcome(t *testing.T) {
+	breaker := newCircuitBreaker("keystone", 1, 0.5, 50*time.Millisecond)
+
+	errDown := errors.New("connection refused")
+	isFailure := func(err error) bool { return err != ErrWrongCredentials }
+
+	breaker.do(func() error { return errDown }, isFailure)
+	if breaker.state != circuitOpen {
+		t.Fatal("Circuit should be open")
+	}
+
+	// probe rejected by the rate limiter
+	time.Sleep(100 * time.Millisecond)
+	breaker.do(func() error { return ErrBackendUnavailable }, isFailure)
+	if breaker.state != circuitOpen {
+		t.Fatalf("A probe rejected by the rate limiter shouldn't close the circuit, got %s", breaker.state)
+	}
+
+	// probe panicking
+	func() {
+		defer func() { recover() }()
+		breaker.do(func() error { panic("probe") }, isFailure)
+	}()
+	if breaker.state != circuitOpen {
+		t.Fatalf("A panicking probe should release the circuit, got %s", breaker.state)
+	}
+
+	called := false
+	breaker.do(func() error { called = true; return nil }, isFailure)
+	if !called || breaker.state != circuitClosed {
+		t.Fatalf("A new probe should be let through and close the circuit, got %s", breaker.state)
+	}
+}
@@ -0,0 +1,260 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
+	"github.com/skydive-project/skydive/rbac"
+)
+
+const (
+	breakGlassBackend      = "break-glass"
+	breakGlassMinSecretLen = 16
+
+	// the Basic authentications from an address are reported once, again
+	// only when the address stayed unused for this interval
+	breakGlassAlertInterval = 15 * time.Minute
+)
+
+// breakGlassAccount is an emergency account authenticated locally, whatever
+// the authentication backend, so that operators keep access during an outage
+// of the identity provider. Every use is logged and optionally reported to a
+// webhook.
+type breakGlassAccount struct {
+	username string
+	digest   [sha256.Size]byte
+	role     string
+	timeout  time.Duration
+	webhook  string
+
+	lock sync.Mutex
+	uses map[string]time.Time
+}
+
+var (
+	breakGlass     *breakGlassAccount
+	breakGlassErr  error
+	breakGlassOnce sync.Once
+)
+
+func breakGlassDigest(username, password string) [sha256.Size]byte {
+	return sha256.Sum256([]byte(username + ":" + password))
+}
+
+// match returns whether the credentials are the ones of the account
+func (b *breakGlassAccount) match(username, password string) bool {
+	if b == nil {
+		return false
+	}
+
+	digest := breakGlassDigest(username, password)
+	return subtle.ConstantTimeCompare(digest[:], b.digest[:]) == 1
+}
+
+// grant gives the role of the account to the user
+func (b *breakGlassAccount) grant() {
+	for _, role := range rbac.GetUserRoles(b.username) {
+		if role == b.role {
+			return
+		}
+	}
+	rbac.AddRoleForUser(b.username, b.role)
+}
+
+// validSession returns whether the session is an active session of the
+// account, whatever its use the session expires after the account timeout,
+// 0 meaning no timeout
+func (b *breakGlassAccount) validSession(id string) bool {
+	session, ok := sessions.lookup(breakGlassBackend, id)
+	if ok && b.timeout > 0 && time.Since(session.Issued) > b.timeout {
+		sessions.end(id)
+		return false
+	}
+	return ok
+}
+
+// login authenticates the account with the login endpoint, returns the
+// identifier of the session opened. A session store is required, otherwise
+// the account can only be used with Basic credentials.
+func (b *breakGlassAccount) login(w http.ResponseWriter, username, password string) (string, bool, error) {
+	if !b.match(username, password) {
+		return "", false, nil
+	}
+
+	id, timeout, err := sessions.start(&SessionInfo{Backend: breakGlassBackend}, "", b.timeout)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to open a session for the break-glass account %s: %s", username, err)
+		return "", true, err
+	}
+	b.grant()
+
+	logging.GetLogger().Warningf("Login with the break-glass account %s", username)
+	b.alert("login", username, "")
+
+	if cookieAuthEnabled() {
+		http.SetCookie(w, sessionCookie(id, timeout))
+	}
+	setPermissionsCookie(w, username)
+
+	return id, true, nil
+}
+
+// authenticateRequest authenticates a request carrying a session token or
+// the credentials of the account, returns false for any other request
+func (b *breakGlassAccount) authenticateRequest(r *http.Request) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+
+	if cookie, err := r.Cookie(tokenName); err == nil && cookieAuthEnabled() && b.validSession(cookie.Value) {
+		logging.GetLogger().Warningf("Break-glass account %s used from %s for %s %s", b.username, r.RemoteAddr, r.Method, r.URL)
+		return b.username, true
+	}
+
+	if username, password, ok := basicCredentials(requestAuthorization(r)); ok && b.match(username, password) {
+		b.grant()
+		logging.GetLogger().Warningf("Break-glass account %s authenticated from %s for %s %s", b.username, r.RemoteAddr, r.Method, r.URL)
+		if b.firstUse(r.RemoteAddr) {
+			b.alert("authentication", b.username, r.RemoteAddr)
+		}
+		return b.username, true
+	}
+
+	return "", false
+}
+
+// firstUse records a Basic authentication from an address, returns whether
+// it is the first one since the address stayed unused for the alert interval
+func (b *breakGlassAccount) firstUse(remote string) bool {
+	if host, _, err := net.SplitHostPort(remote); err == nil {
+		remote = host
+	}
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if used, ok := b.uses[remote]; ok && now.Sub(used) <= breakGlassAlertInterval {
+		b.uses[remote] = now
+		return false
+	}
+
+	// the addresses unused for long are only pruned on an alert
+	for address, used := range b.uses {
+		if now.Sub(used) > breakGlassAlertInterval {
+			delete(b.uses, address)
+		}
+	}
+	if b.uses == nil {
+		b.uses = make(map[string]time.Time)
+	}
+	b.uses[remote] = now
+
+	return true
+}
+
+// alert reports an authentication of the account to the webhook
+func (b *breakGlassAccount) alert(event, username, remote string) {
+	if b.webhook == "" {
+		return
+	}
+
+	body, _ := json.Marshal(struct {
+		Event    string
+		Username string
+		Remote   string `json:",omitempty"`
+		Time     time.Time
+	}{Event: event, Username: username, Remote: remote, Time: time.Now().UTC()})
+
+	go func() {
+		client := &http.Client{Timeout: 5 * time.Second}
+		resp, err := client.Post(b.webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			logging.GetLogger().Errorf("Failed to report the break-glass account use to %s: %s", b.webhook, err)
+			return
+		}
+		resp.Body.Close()
+	}()
+}
+
+// newBreakGlassAccountFromConfig returns the break-glass account if enabled,
+// its secret being read from a file
+func newBreakGlassAccountFromConfig() (*breakGlassAccount, error) {
+	if !config.GetBool("http.auth.break_glass.enabled") {
+		return nil, nil
+	}
+
+	username := config.GetString("http.auth.break_glass.username")
+	if username == "" {
+		return nil, fmt.Errorf("No username defined for the break-glass account")
+	}
+
+	file := config.GetString("http.auth.break_glass.password_file")
+	if file == "" {
+		return nil, fmt.Errorf("No password file defined for the break-glass account")
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the break-glass account password: %s", err)
+	}
+	password := strings.TrimSpace(string(content))
+	if len(password) < breakGlassMinSecretLen {
+		return nil, fmt.Errorf("The break-glass account password has to be at least %d characters long", breakGlassMinSecretLen)
+	}
+
+	role := config.GetString("http.auth.break_glass.role")
+	if !rbac.RoleExists(role) {
+		return nil, fmt.Errorf("Role %s of the break-glass account is not defined in the RBAC policy", role)
+	}
+
+	logging.GetLogger().Warningf("Break-glass account %s enabled, it authenticates whatever the authentication backend", username)
+
+	return &breakGlassAccount{
+		username: username,
+		digest:   breakGlassDigest(username, password),
+		role:     role,
+		timeout:  time.Duration(config.GetInt("http.auth.break_glass.session_timeout")) * time.Second,
+		webhook:  config.GetString("http.auth.break_glass.webhook"),
+	}, nil
+}
+
+// initBreakGlassAccount loads the break-glass account once
+func initBreakGlassAccount() error {
+	breakGlassOnce.Do(func() {
+		breakGlass, breakGlassErr = newBreakGlassAccountFromConfig()
+	})
+	return breakGlassErr
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	auth "github.com/abbot/go-http-auth"
+)
+
+func TestBreakGlassAccount(t *testing.T) {
+	defer useMemorySessions()()
+
+	breakGlass = &breakGlassAccount{
+		username: "breakglass",
+		digest:   breakGlassDigest("breakglass", "0123456789abcdef"),
+		role:     defaultUserRole,
+		timeout:  time.Minute,
+	}
+	defer func() { breakGlass = nil }()
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var username string
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) { username = r.Username })
+
+	// credentials in the header
+	r := &http.Request{Header: make(http.Header)}
+	r.SetBasicAuth("breakglass", "0123456789abcdef")
+	handler(&fakeResponseWriter{headers: make(http.Header)}, r)
+
+	if username != "breakglass" {
+		t.Fatalf("The break-glass account should be authenticated, got %s", username)
+	}
+
+	// wrong password
+	username = ""
+	r = &http.Request{Header: make(http.Header)}
+	r.SetBasicAuth("breakglass", "wrong")
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	handler(w, r)
+
+	if username != "" || w.status != http.StatusUnauthorized {
+		t.Fatalf("Wrong password should be rejected, got user %s and status %d", username, w.status)
+	}
+
+	// login then session cookie
+	w = &fakeResponseWriter{headers: make(http.Header)}
+	_, id, err := authenticateSession(context.Background(), basic, w, "breakglass", "0123456789abcdef", true)
+	if err != nil || id == "" {
+		t.Fatalf("Login of the break-glass account failed: %v", err)
+	}
+
+	username = ""
+	r = &http.Request{Header: make(http.Header)}
+	r.AddCookie(AuthCookie(id, "/"))
+	handler(&fakeResponseWriter{headers: make(http.Header)}, r)
+
+	if username != "breakglass" {
+		t.Errorf("The break-glass session should be authenticated, got %s", username)
+	}
+}
+
+func TestBreakGlassAlerts(t *testing.T) {
+	defer useMemorySessions()()
+
+	alerts := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var alert struct{ Event, Remote string }
+		json.NewDecoder(r.Body).Decode(&alert)
+		alerts <- alert.Event + " " + alert.Remote
+	}))
+	defer server.Close()
+
+	account := &breakGlassAccount{
+		username: "breakglass",
+		digest:   breakGlassDigest("breakglass", "0123456789abcdef"),
+		role:     defaultUserRole,
+		webhook:  server.URL,
+	}
+
+	// the Basic authentications are reported once per address
+	for _, remote := range []string{"10.0.0.1:1234", "10.0.0.1:1235", "10.0.0.2:1234"} {
+		r := &http.Request{Header: make(http.Header), RemoteAddr: remote, URL: &url.URL{Path: "/api"}}
+		r.SetBasicAuth("breakglass", "0123456789abcdef")
+		if _, ok := account.authenticateRequest(r); !ok {
+			t.Fatalf("The break-glass account should be authenticated from %s", remote)
+		}
+	}
+
+	var received []string
+	for len(received) < 2 {
+		select {
+		case alert := <-alerts:
+			received = append(received, alert)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Expected 2 alerts, got %v", received)
+		}
+	}
+	select {
+	case alert := <-alerts:
+		t.Errorf("Unexpected alert %s, got already %v", alert, received)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// no timeout
+	id, _, err := sessions.start(&SessionInfo{Backend: breakGlassBackend}, "", account.timeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !account.validSession(id) {
+		t.Error("A session shouldn't expire with a 0 timeout")
+	}
+}
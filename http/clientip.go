@@ -0,0 +1,88 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
+)
+
+// ipInCIDRs returns whether an IP belongs to one of the given ranges, a
+// range being either a CIDR or a single address
+func ipInCIDRs(ip net.IP, cidrs []string) bool {
+	for _, cidr := range cidrs {
+		if !strings.Contains(cidr, "/") {
+			if addr := net.ParseIP(cidr); addr != nil && addr.Equal(ip) {
+				return true
+			}
+			continue
+		}
+
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			logging.GetLogger().Errorf("Invalid CIDR %s: %s", cidr, err)
+			continue
+		}
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the IP of the client of a request. The X-Forwarded-For
+// header is only taken into account when the request comes from one of the
+// trusted proxies, the client being the first address not belonging to them
+// starting from the right.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return nil
+	}
+
+	proxies := config.GetStringSlice("http.trusted_proxies")
+	if !ipInCIDRs(ip, proxies) {
+		return ip
+	}
+
+	forwarded := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		addr := net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if addr == nil {
+			break
+		}
+		ip = addr
+		if !ipInCIDRs(ip, proxies) {
+			break
+		}
+	}
+	return ip
+}
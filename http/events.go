@@ -0,0 +1,179 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
+)
+
+// AuthEventType describes the type of an authentication event
+type AuthEventType string
+
+const (
+	// AuthEventLogin successful login
+	AuthEventLogin AuthEventType = "login"
+	// AuthEventLoginFailure failed login
+	AuthEventLoginFailure AuthEventType = "login_failure"
+	// AuthEventLogout logout
+	AuthEventLogout AuthEventType = "logout"
+	// AuthEventLockout login refused because the account is locked
+	AuthEventLockout AuthEventType = "lockout"
+)
+
+// AuthEvent describes an authentication event
+type AuthEvent struct {
+	Type     AuthEventType
+	Username string
+	Backend  string
+	Remote   string
+	Time     time.Time
+}
+
+// AuthEventListener is the interface to be implemented by the authentication
+// event listeners
+type AuthEventListener interface {
+	OnAuthEvent(event AuthEvent)
+}
+
+// authEventSubscriber queues the events of a subscriber so that a slow
+// subscriber never blocks the authentication
+type authEventSubscriber struct {
+	id       int64
+	queue    chan AuthEvent
+	listener AuthEventListener
+	dropped  int64
+}
+
+var authEventSubscribers = struct {
+	sync.RWMutex
+	lastID      int64
+	subscribers []*authEventSubscriber
+}{}
+
+// addAuthEventSubscriber registers a new subscriber of the events
+func addAuthEventSubscriber(listener AuthEventListener) *authEventSubscriber {
+	size := config.GetInt("http.auth.events.buffer")
+	if size <= 0 {
+		size = 1
+	}
+
+	authEventSubscribers.Lock()
+	defer authEventSubscribers.Unlock()
+
+	authEventSubscribers.lastID++
+	s := &authEventSubscriber{id: authEventSubscribers.lastID, queue: make(chan AuthEvent, size), listener: listener}
+	authEventSubscribers.subscribers = append(authEventSubscribers.subscribers, s)
+	return s
+}
+
+// removeAuthEventSubscriber ends a subscription, closing its queue
+func removeAuthEventSubscriber(id int64) {
+	authEventSubscribers.Lock()
+	defer authEventSubscribers.Unlock()
+
+	for i, s := range authEventSubscribers.subscribers {
+		if s.id == id {
+			authEventSubscribers.subscribers = append(authEventSubscribers.subscribers[:i], authEventSubscribers.subscribers[i+1:]...)
+			close(s.queue)
+			break
+		}
+	}
+}
+
+// push queues an event according to the drop policy when the queue is full
+func (s *authEventSubscriber) push(event AuthEvent, dropOldest bool) {
+	for {
+		select {
+		case s.queue <- event:
+			return
+		default:
+		}
+
+		if dropped := atomic.AddInt64(&s.dropped, 1); dropped == 1 || dropped%100 == 0 {
+			logging.GetLogger().Warningf("Authentication event subscriber too slow, %d events dropped", dropped)
+		}
+
+		if !dropOldest {
+			return
+		}
+		select {
+		case <-s.queue:
+		default:
+		}
+	}
+}
+
+// AddAuthEventListener subscribes a listener to the authentication events
+// and returns the identifier of the subscription. The listener is called
+// from its own goroutine.
+func AddAuthEventListener(l AuthEventListener) int64 {
+	s := addAuthEventSubscriber(l)
+	go func() {
+		for event := range s.queue {
+			s.listener.OnAuthEvent(event)
+		}
+	}()
+	return s.id
+}
+
+// RemoveAuthEventListener ends the subscription of a listener given its
+// identifier
+func RemoveAuthEventListener(id int64) {
+	removeAuthEventSubscriber(id)
+}
+
+// SubscribeAuthEvents returns a channel receiving the authentication events
+// along with the function ending the subscription
+func SubscribeAuthEvents() (<-chan AuthEvent, func()) {
+	s := addAuthEventSubscriber(nil)
+	return s.queue, func() { removeAuthEventSubscriber(s.id) }
+}
+
+// notifyAuthEvent sends an event to the subscribers without blocking
+func notifyAuthEvent(typ AuthEventType, username string, backend AuthenticationBackend, r *http.Request) {
+	event := AuthEvent{
+		Type:     typ,
+		Username: username,
+		Backend:  backend.Name(),
+		Time:     time.Now().UTC(),
+	}
+	if ip := clientIP(r); ip != nil {
+		event.Remote = ip.String()
+	}
+
+	dropOldest := config.GetString("http.auth.events.drop") == "oldest"
+
+	// the lock being held while pushing, a subscription can't end meanwhile
+	authEventSubscribers.RLock()
+	defer authEventSubscribers.RUnlock()
+
+	for _, s := range authEventSubscribers.subscribers {
+		s.push(event, dropOldest)
+	}
+}
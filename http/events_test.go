@@ -0,0 +1,115 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	auth "github.com/abbot/go-http-auth"
+	"github.com/skydive-project/skydive/config"
+)
+
+type blockingAuthEventListener struct {
+	release chan struct{}
+}
+
+func (l *blockingAuthEventListener) OnAuthEvent(event AuthEvent) {
+	<-l.release
+}
+
+func TestAuthEventsSlowSubscriber(t *testing.T) {
+	config.Set("http.auth.events.buffer", 2)
+	defer config.Set("http.auth.events.buffer", 100)
+
+	listener := &blockingAuthEventListener{release: make(chan struct{})}
+	defer RemoveAuthEventListener(AddAuthEventListener(listener))
+	defer close(listener.release)
+
+	events, unsubscribe := SubscribeAuthEvents()
+	defer unsubscribe()
+
+	backend := NewNoAuthenticationBackend()
+	r := &http.Request{Header: make(http.Header), RemoteAddr: "10.0.0.1:1234"}
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 10; i++ {
+			notifyAuthEvent(AuthEventLogin, "user1", backend, r)
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("A slow subscriber shouldn't block the notification")
+	}
+
+	event := <-events
+	if event.Type != AuthEventLogin || event.Username != "user1" || event.Remote != "10.0.0.1" {
+		t.Errorf("Unexpected event: %+v", event)
+	}
+}
+
+// funcAuthEventListener is a listener of a non comparable type
+type funcAuthEventListener func(event AuthEvent)
+
+func (f funcAuthEventListener) OnAuthEvent(event AuthEvent) {
+	f(event)
+}
+
+func TestAuthEventsHeaderAuthentication(t *testing.T) {
+	received := make(chan AuthEvent, 10)
+	id := AddAuthEventListener(funcAuthEventListener(func(event AuthEvent) { received <- event }))
+	defer RemoveAuthEventListener(id)
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {})
+
+	for _, test := range []struct {
+		password string
+		typ      AuthEventType
+	}{
+		{"pass1", AuthEventLogin},
+		{"pass2", AuthEventLoginFailure},
+	} {
+		r := &http.Request{Header: make(http.Header), RemoteAddr: "10.0.0.1:1234"}
+		r.SetBasicAuth("user1", test.password)
+		handler(&fakeResponseWriter{headers: make(http.Header)}, r)
+
+		select {
+		case event := <-received:
+			if event.Type != test.typ || event.Username != "user1" {
+				t.Errorf("Expected %s event of user1, got %+v", test.typ, event)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("No %s event received", test.typ)
+		}
+	}
+}
@@ -0,0 +1,368 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	auth "github.com/abbot/go-http-auth"
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
+)
+
+// Requests are signed as follow:
+//
+//	string to sign = METHOD + "\n" +
+//	                 host the request is sent to + "\n" +
+//	                 request URI, path and raw query as sent + "\n" +
+//	                 value of the Date header + "\n" +
+//	                 value of the X-Request-ID header + "\n" +
+//	                 lower case hex encoded SHA-256 of the body
+//
+//	signature = base64(HMAC-SHA256(secret, string to sign))
+//
+// and carried in the header:
+//
+//	Authorization: Skydive-HMAC-SHA256 KeyId=<key id>, Signature=<signature>
+//
+// The Date header uses the HTTP format (RFC 1123, GMT) and has to be within the
+// clock skew window of the server time. The X-Request-ID header is a random
+// value unique to each request, so that identical requests sent within the
+// same second get different signatures. A signature is accepted only once.
+// The signatures seen are kept in memory by each analyzer, a request can then
+// be replayed against another analyzer of a cluster within the clock skew
+// window.
+const (
+	hmacAuthScheme       = "Skydive-HMAC-SHA256"
+	hmacRequestIDHeader  = "X-Request-ID"
+	hmacMaxBodySize      = 10 * 1024 * 1024
+	hmacDefaultClockSkew = 300
+)
+
+// HMACKey defines a shared secret and the user it authenticates
+type HMACKey struct {
+	Secret   string
+	Username string
+	Role     string
+}
+
+// HMACAuthenticationBackend authenticates signed requests
+type HMACAuthenticationBackend struct {
+	sync.Mutex
+	name      string
+	role      string
+	keys      map[string]HMACKey
+	clockSkew time.Duration
+	seen      map[string]time.Time
+	expiries  []seenSignature
+}
+
+// seenSignature is an entry of the queue of the signatures seen, ordered by
+// expiration
+type seenSignature struct {
+	signature string
+	expire    time.Time
+}
+
+// Name returns the name of the backend
+func (b *HMACAuthenticationBackend) Name() string {
+	return b.name
+}
+
+// DefaultUserRole returns the role of the key of the user if any, otherwise
+// the default role of the backend. When several keys of the user define a
+// role, the one of the first key id in lexical order is used.
+func (b *HMACAuthenticationBackend) DefaultUserRole(user string) string {
+	ids := make([]string, 0, len(b.keys))
+	for id := range b.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	for _, id := range ids {
+		if key := b.keys[id]; key.Username == user && key.Role != "" {
+			return key.Role
+		}
+	}
+	return b.role
+}
+
+func (b *HMACAuthenticationBackend) mappedRoles() (roles []string) {
+	for _, key := range b.keys {
+		if key.Role != "" {
+			roles = append(roles, key.Role)
+		}
+	}
+	return
+}
+
+// Capabilities returns the features supported by the backend, each request
+// being signed there is no login
+func (b *HMACAuthenticationBackend) Capabilities() AuthBackendCapabilities {
+	return AuthBackendCapabilities{}
+}
+
+// SetDefaultUserRole defines the default user role
+func (b *HMACAuthenticationBackend) SetDefaultUserRole(role string) {
+	b.role = role
+}
+
+// Authenticate is not supported as each request has to be signed
+func (b *HMACAuthenticationBackend) Authenticate(username string, password string) (string, error) {
+	return "", ErrWrongCredentials
+}
+
+func hmacStringToSign(r *http.Request, body []byte) string {
+	sum := sha256.Sum256(body)
+	host := r.Host
+	if host == "" {
+		host = r.URL.Host
+	}
+	return r.Method + "\n" + host + "\n" + r.URL.RequestURI() + "\n" + r.Header.Get("Date") + "\n" + r.Header.Get(hmacRequestIDHeader) + "\n" + hex.EncodeToString(sum[:])
+}
+
+func hmacSignature(secret string, stringToSign string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(stringToSign))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// readSignedBody reads the body of the request and replaces it so that it can be
+// read again by the handler
+func readSignedBody(r *http.Request) ([]byte, error) {
+	if r.Body == nil {
+		return nil, nil
+	}
+
+	body, err := ioutil.ReadAll(io.LimitReader(r.Body, hmacMaxBodySize+1))
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if len(body) > hmacMaxBodySize {
+		return nil, errors.New("Request body too large to be signed")
+	}
+	r.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	return body, nil
+}
+
+// SignRequest signs a request with the given key, setting the Date and the
+// X-Request-ID headers when not already present
+func SignRequest(r *http.Request, keyID, secret string) error {
+	if r.Header.Get("Date") == "" {
+		r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	}
+
+	if r.Header.Get(hmacRequestIDHeader) == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return err
+		}
+		r.Header.Set(hmacRequestIDHeader, hex.EncodeToString(id))
+	}
+
+	body, err := readSignedBody(r)
+	if err != nil {
+		return err
+	}
+
+	signature := hmacSignature(secret, hmacStringToSign(r, body))
+	r.Header.Set("Authorization", fmt.Sprintf("%s KeyId=%s, Signature=%s", hmacAuthScheme, keyID, signature))
+
+	return nil
+}
+
+func parseHMACAuthorization(authorization string) (keyID string, signature string, err error) {
+	s := strings.SplitN(authorization, " ", 2)
+	if len(s) != 2 || s[0] != hmacAuthScheme {
+		return "", "", ErrWrongCredentials
+	}
+
+	for _, param := range strings.Split(s[1], ",") {
+		kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+		if len(kv) != 2 {
+			return "", "", ErrWrongCredentials
+		}
+
+		switch kv[0] {
+		case "KeyId":
+			keyID = kv[1]
+		case "Signature":
+			signature = kv[1]
+		}
+	}
+
+	if keyID == "" || signature == "" {
+		return "", "", ErrWrongCredentials
+	}
+
+	return keyID, signature, nil
+}
+
+// markSeen records a signature, returns false if it has already been used
+// within the clock skew window. The signatures are only known by this
+// analyzer.
+func (b *HMACAuthenticationBackend) markSeen(signature string, now time.Time) bool {
+	b.Lock()
+	defer b.Unlock()
+
+	// only the expired signatures at the head of the queue are pruned, each
+	// signature being pruned once
+	for len(b.expiries) > 0 && now.After(b.expiries[0].expire) {
+		if oldest := b.expiries[0]; b.seen[oldest.signature] == oldest.expire {
+			delete(b.seen, oldest.signature)
+		}
+		b.expiries = b.expiries[1:]
+	}
+
+	if expire, ok := b.seen[signature]; ok && !now.After(expire) {
+		return false
+	}
+
+	expire := now.Add(2 * b.clockSkew)
+	b.seen[signature] = expire
+	b.expiries = append(b.expiries, seenSignature{signature: signature, expire: expire})
+
+	return true
+}
+
+// CheckRequest verifies the signature of the request and returns the user
+// bound to the key used
+func (b *HMACAuthenticationBackend) CheckRequest(r *http.Request) (string, error) {
+	keyID, signature, err := parseHMACAuthorization(requestAuthorization(r))
+	if err != nil {
+		return "", err
+	}
+
+	key, ok := b.keys[keyID]
+	if !ok {
+		return "", ErrWrongCredentials
+	}
+
+	date, err := http.ParseTime(r.Header.Get("Date"))
+	if err != nil || r.Header.Get(hmacRequestIDHeader) == "" {
+		return "", ErrWrongCredentials
+	}
+
+	now := time.Now()
+	if skew := now.Sub(date); skew > b.clockSkew || skew < -b.clockSkew {
+		return "", fmt.Errorf("Request date outside of the allowed clock skew: %s", date)
+	}
+
+	body, err := readSignedBody(r)
+	if err != nil {
+		return "", err
+	}
+
+	expected := hmacSignature(key.Secret, hmacStringToSign(r, body))
+	if !hmac.Equal([]byte(expected), []byte(signature)) {
+		return "", ErrWrongCredentials
+	}
+
+	if !b.markSeen(signature, now) {
+		return "", fmt.Errorf("Replayed request signature for key %s", keyID)
+	}
+
+	return key.Username, nil
+}
+
+func (b *HMACAuthenticationBackend) authenticateRequest(w http.ResponseWriter, r *http.Request) (string, error) {
+	username, err := b.CheckRequest(r)
+	if err != nil {
+		logging.GetLogger().Debugf("HMAC authentication error: %s", err)
+		return "", err
+	}
+
+	if r.Context().Err() != nil {
+		return "", ErrAuthTimeout
+	}
+
+	provisionRole(b, username)
+
+	return username, nil
+}
+
+func (b *HMACAuthenticationBackend) Wrap(wrapped auth.AuthenticatedHandlerFunc) http.HandlerFunc {
+	return wrapAuthenticated(b, b.authenticateRequest, wrapped)
+}
+
+// NewHMACAuthenticationBackend returns a new backend verifying requests signed
+// with the given keys, indexed by key id
+func NewHMACAuthenticationBackend(name string, keys map[string]HMACKey, role string, clockSkew time.Duration) (*HMACAuthenticationBackend, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("No key defined for the HMAC authentication")
+	}
+
+	for id, key := range keys {
+		if key.Secret == "" || key.Username == "" {
+			return nil, fmt.Errorf("Secret and username required for HMAC key %s", id)
+		}
+	}
+
+	return &HMACAuthenticationBackend{
+		name:      name,
+		role:      role,
+		keys:      keys,
+		clockSkew: clockSkew,
+		seen:      make(map[string]time.Time),
+	}, nil
+}
+
+func NewHMACAuthenticationBackendFromConfig(name string) (*HMACAuthenticationBackend, error) {
+	role := config.GetString("auth." + name + ".role")
+	if role == "" {
+		role = defaultUserRole
+	}
+
+	clockSkew := hmacDefaultClockSkew
+	if config.IsSet("auth." + name + ".clock_skew") {
+		clockSkew = config.GetInt("auth." + name + ".clock_skew")
+	}
+
+	keys := make(map[string]HMACKey)
+	for id := range config.GetStringMap("auth." + name + ".keys") {
+		prefix := "auth." + name + ".keys." + id
+		keys[id] = HMACKey{
+			Secret:   config.GetString(prefix + ".secret"),
+			Username: config.GetString(prefix + ".username"),
+			Role:     config.GetString(prefix + ".role"),
+		}
+	}
+
+	return NewHMACAuthenticationBackend(name, keys, role, time.Duration(clockSkew)*time.Second)
+}
@@ -0,0 +1,167 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	auth "github.com/abbot/go-http-auth"
+)
+
+func TestHMACAuthenticate(t *testing.T) {
+	keys := map[string]HMACKey{"key1": {Secret: "secret1", Username: "user1"}}
+	backend, err := NewHMACAuthenticationBackend("hmac", keys, defaultUserRole, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var username, body string
+	handler := backend.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+		username = r.Username
+		b, _ := ioutil.ReadAll(r.Body)
+		body = string(b)
+	})
+
+	newRequest := func(secret string, date time.Time) *http.Request {
+		r, _ := http.NewRequest("POST", "http://localhost/api/capture?x=1", strings.NewReader(`{"GremlinQuery": "G.V()"}`))
+		r.Header.Set("Date", date.UTC().Format(http.TimeFormat))
+		if err := SignRequest(r, "key1", secret); err != nil {
+			t.Fatal(err)
+		}
+		return r
+	}
+
+	serve := func(r *http.Request) int {
+		username, body = "", ""
+		w := &fakeResponseWriter{headers: make(http.Header)}
+		handler(w, r)
+		return w.status
+	}
+
+	r := newRequest("secret1", time.Now())
+	if status := serve(r); status == http.StatusUnauthorized || username != "user1" {
+		t.Fatalf("Signed request should be authenticated as user1, got '%s'", username)
+	}
+	if body != `{"GremlinQuery": "G.V()"}` {
+		t.Errorf("Body should be readable by the handler, got: %s", body)
+	}
+
+	// replay of the same request
+	replay, _ := http.NewRequest("POST", "http://localhost/api/capture?x=1", strings.NewReader(`{"GremlinQuery": "G.V()"}`))
+	replay.Header = r.Header
+	if status := serve(replay); status != http.StatusUnauthorized {
+		t.Error("Replayed request should be rejected")
+	}
+
+	// identical request sent within the same second
+	date, _ := http.ParseTime(r.Header.Get("Date"))
+	if status := serve(newRequest("secret1", date)); status == http.StatusUnauthorized {
+		t.Error("Identical requests with different request IDs should be accepted")
+	}
+
+	// request sent to another host
+	r = newRequest("secret1", time.Now())
+	r.Host = "otherhost"
+	if status := serve(r); status != http.StatusUnauthorized {
+		t.Error("Request sent to another host should be rejected")
+	}
+
+	// missing request ID
+	r, _ = http.NewRequest("GET", "http://localhost/api/capture", nil)
+	r.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+	r.Header.Set("Authorization", hmacAuthScheme+" KeyId=key1, Signature="+hmacSignature("secret1", hmacStringToSign(r, nil)))
+	if status := serve(r); status != http.StatusUnauthorized {
+		t.Error("Request without request ID should be rejected")
+	}
+
+	// tampered body
+	r = newRequest("secret1", time.Now().Add(-2*time.Second))
+	r.Body = ioutil.NopCloser(strings.NewReader(`{"GremlinQuery": "G.V().Has('Name', 'eth0')"}`))
+	if status := serve(r); status != http.StatusUnauthorized {
+		t.Error("Request with a tampered body should be rejected")
+	}
+
+	// wrong secret
+	if status := serve(newRequest("secret2", time.Now())); status != http.StatusUnauthorized {
+		t.Error("Request signed with a wrong secret should be rejected")
+	}
+
+	// outside of the clock skew window
+	if status := serve(newRequest("secret1", time.Now().Add(-2*time.Minute))); status != http.StatusUnauthorized {
+		t.Error("Request with a date outside of the clock skew should be rejected")
+	}
+}
+
+func TestHMACDefaultUserRole(t *testing.T) {
+	keys := map[string]HMACKey{
+		"key3": {Secret: "secret3", Username: "user1", Role: "guest"},
+		"key1": {Secret: "secret1", Username: "user1", Role: "admin"},
+		"key2": {Secret: "secret2", Username: "user1", Role: "guest"},
+		"key4": {Secret: "secret4", Username: "user2"},
+	}
+	backend, err := NewHMACAuthenticationBackend("hmac", keys, defaultUserRole, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 10; i++ {
+		if role := backend.DefaultUserRole("user1"); role != "admin" {
+			t.Fatalf("Expected the role of the first key, got %s", role)
+		}
+	}
+	if role := backend.DefaultUserRole("user2"); role != defaultUserRole {
+		t.Errorf("Expected the default role, got %s", role)
+	}
+}
+
+func TestHMACSeenSignatures(t *testing.T) {
+	keys := map[string]HMACKey{"key1": {Secret: "secret1", Username: "user1"}}
+	backend, err := NewHMACAuthenticationBackend("hmac", keys, defaultUserRole, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	if !backend.markSeen("sig1", now) || !backend.markSeen("sig2", now.Add(time.Second)) {
+		t.Fatal("New signatures should be accepted")
+	}
+	if backend.markSeen("sig1", now.Add(time.Minute)) {
+		t.Error("A replayed signature should be refused within the window")
+	}
+
+	// the expired signatures are pruned and accepted again
+	later := now.Add(2*time.Minute + 2*time.Second)
+	if !backend.markSeen("sig1", later) {
+		t.Error("An expired signature should be accepted")
+	}
+	if len(backend.seen) != 1 || len(backend.expiries) != 1 {
+		t.Errorf("The expired signatures should be pruned, got %d signatures and %d entries", len(backend.seen), len(backend.expiries))
+	}
+	if backend.markSeen("sig1", later.Add(time.Second)) {
+		t.Error("A signature accepted again should be refused within the new window")
+	}
+}
@@ -23,6 +23,7 @@
 package http
 
 import (
+	"crypto/tls"
 	"errors"
 	"net/http"
 	"strings"
@@ -38,11 +39,13 @@ import (
 )
 
 type KeystoneAuthenticationBackend struct {
-	AuthURL string
-	Tenant  string
-	Domain  string
-	name    string
-	role    string
+	AuthURL   string
+	Tenant    string
+	Domain    string
+	name      string
+	role      string
+	tlsConfig *tls.Config
+	guard     *outboundGuard
 }
 
 type User struct {
@@ -55,6 +58,17 @@ func (b *KeystoneAuthenticationBackend) Name() string {
 	return b.name
 }
 
+// Realm returns the domain the users are authenticated against
+func (b *KeystoneAuthenticationBackend) Realm() string {
+	return b.Domain
+}
+
+// Capabilities returns the features supported by the backend, the tokens
+// being revocable with the identity API v3 only
+func (b *KeystoneAuthenticationBackend) Capabilities() AuthBackendCapabilities {
+	return AuthBackendCapabilities{Login: true, Revocation: b.Domain != ""}
+}
+
 // DefaultUserRole return the default user role
 func (b *KeystoneAuthenticationBackend) DefaultUserRole(user string) string {
 	return b.role
@@ -65,6 +79,18 @@ func (b *KeystoneAuthenticationBackend) SetDefaultUserRole(role string) {
 	b.role = role
 }
 
+// isKeystoneFailure returns whether an error denotes a failing keystone
+// rather than rejected credentials or token
+func isKeystoneFailure(err error) bool {
+	switch e := err.(type) {
+	case gophercloud.ErrDefault400, gophercloud.ErrDefault401, gophercloud.ErrDefault404:
+		return false
+	case gophercloud.ErrUnexpectedResponseCode:
+		return e.Actual >= 500
+	}
+	return err != ErrWrongCredentials
+}
+
 func (b *KeystoneAuthenticationBackend) checkUserV2(client *gophercloud.ServiceClient, tokenID string) (string, error) {
 	result := tokens2.Get(client, tokenID)
 
@@ -88,6 +114,9 @@ func (b *KeystoneAuthenticationBackend) checkUserV2(client *gophercloud.ServiceC
 
 func (b *KeystoneAuthenticationBackend) checkUserV3(client *gophercloud.ServiceClient, tokenID string) (string, error) {
 	result := tokens3.Get(client, tokenID)
+	if result.Err != nil {
+		return "", result.Err
+	}
 
 	type Role struct {
 		Name string `mapstructure:"name"`
@@ -117,8 +146,24 @@ func (b *KeystoneAuthenticationBackend) checkUserV3(client *gophercloud.ServiceC
 	return response.Token.User.Name, nil
 }
 
-func (b *KeystoneAuthenticationBackend) CheckUser(token string) (string, error) {
+func (b *KeystoneAuthenticationBackend) newProviderClient() (*gophercloud.ProviderClient, error) {
 	provider, err := openstack.NewClient(b.AuthURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// keep the proxy and the timeouts of the default transport
+	if b.tlsConfig != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = b.tlsConfig
+		provider.HTTPClient = http.Client{Transport: transport}
+	}
+
+	return provider, nil
+}
+
+func (b *KeystoneAuthenticationBackend) CheckUser(token string) (user string, err error) {
+	provider, err := b.newProviderClient()
 	if err != nil {
 		return "", err
 	}
@@ -129,14 +174,50 @@ func (b *KeystoneAuthenticationBackend) CheckUser(token string) (string, error)
 		Endpoint:       b.AuthURL,
 	}
 
-	if b.Domain != "" {
-		return b.checkUserV3(client, token)
+	err = b.guard.do(func() (err error) {
+		if b.Domain != "" {
+			user, err = b.checkUserV3(client, token)
+		} else {
+			user, err = b.checkUserV2(client, token)
+		}
+		return err
+	}, isKeystoneFailure)
+
+	return user, err
+}
+
+// Revoke invalidates a token, only supported with the identity API v3
+func (b *KeystoneAuthenticationBackend) Revoke(token string) error {
+	if b.Domain == "" {
+		return nil
 	}
 
-	return b.checkUserV2(client, token)
+	provider, err := b.newProviderClient()
+	if err != nil {
+		return err
+	}
+	provider.TokenID = token
+
+	client := &gophercloud.ServiceClient{
+		ProviderClient: provider,
+		Endpoint:       b.AuthURL,
+	}
+
+	return b.guard.do(func() error {
+		return tokens3.Revoke(client, token).Err
+	}, isKeystoneFailure)
 }
 
 func (b *KeystoneAuthenticationBackend) Authenticate(username string, password string) (string, error) {
+	var token string
+	err := b.guard.do(func() (err error) {
+		token, err = b.authenticate(username, password)
+		return err
+	}, isKeystoneFailure)
+	return token, err
+}
+
+func (b *KeystoneAuthenticationBackend) authenticate(username string, password string) (string, error) {
 	opts := gophercloud.AuthOptions{
 		IdentityEndpoint: b.AuthURL,
 		Username:         username,
@@ -145,7 +226,7 @@ func (b *KeystoneAuthenticationBackend) Authenticate(username string, password s
 		DomainName:       b.Domain,
 	}
 
-	provider, err := openstack.NewClient(b.AuthURL)
+	provider, err := b.newProviderClient()
 	if err != nil {
 		return "", err
 	}
@@ -161,23 +242,26 @@ func (b *KeystoneAuthenticationBackend) Authenticate(username string, password s
 	return provider.TokenID, nil
 }
 
-func (b *KeystoneAuthenticationBackend) Wrap(wrapped auth.AuthenticatedHandlerFunc) http.HandlerFunc {
-	return func(w http.ResponseWriter, r *http.Request) {
-		token, err := authenticateWithHeaders(b, w, r)
-		if err != nil {
-			unauthorized(w, r)
-			return
-		}
+func (b *KeystoneAuthenticationBackend) authenticateRequest(w http.ResponseWriter, r *http.Request) (string, error) {
+	token, err := authenticateWithHeaders(b, w, r)
+	if err != nil {
+		return "", err
+	}
 
-		if username, err := b.CheckUser(token); username == "" {
-			if err != nil {
-				logging.GetLogger().Warningf("Failed to check token: %s", err)
-			}
-			unauthorized(w, r)
-		} else {
-			authCallWrapped(w, r, username, wrapped)
+	username, err := b.CheckUser(token)
+	if username == "" {
+		if err == nil {
+			return "", ErrWrongCredentials
 		}
+		logging.GetLogger().Warningf("Failed to check token: %s", err)
+		return "", err
 	}
+
+	return username, nil
+}
+
+func (b *KeystoneAuthenticationBackend) Wrap(wrapped auth.AuthenticatedHandlerFunc) http.HandlerFunc {
+	return wrapAuthenticated(b, b.authenticateRequest, wrapped)
 }
 
 func NewKeystoneBackend(name string, authURL string, tenant string, domain string, role string) (*KeystoneAuthenticationBackend, error) {
@@ -208,5 +292,23 @@ func NewKeystoneAuthenticationBackendFromConfig(name string) (*KeystoneAuthentic
 		role = defaultUserRole
 	}
 
-	return NewKeystoneBackend(name, authURL, tenant, domain, role)
+	backend, err := NewKeystoneBackend(name, authURL, tenant, domain, role)
+	if err != nil {
+		return nil, err
+	}
+
+	// certificate pinning of the keystone endpoint
+	if pins := config.GetStringSlice("auth." + name + ".tls_pin"); len(pins) > 0 {
+		if !strings.HasPrefix(backend.AuthURL, "https://") {
+			return nil, errors.New("TLS pinning requires an https authentication URL")
+		}
+
+		if backend.tlsConfig, err = newPinnedTLSConfig(pins); err != nil {
+			return nil, err
+		}
+	}
+
+	backend.guard = newOutboundGuardFromConfig(name)
+
+	return backend, nil
 }
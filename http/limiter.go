@@ -0,0 +1,98 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
+)
+
+// concurrencyLimiter limits the number of simultaneous calls, the calls
+// waiting for a slot longer than the timeout are rejected
+type concurrencyLimiter struct {
+	slots    chan struct{}
+	timeout  time.Duration
+	waiting  int64
+	rejected int64
+}
+
+// do calls fn once a slot is available, a nil limiter doesn't limit
+func (l *concurrencyLimiter) do(fn func() error) error {
+	if l == nil {
+		return fn()
+	}
+
+	atomic.AddInt64(&l.waiting, 1)
+	timer := time.NewTimer(l.timeout)
+	defer timer.Stop()
+
+	select {
+	case l.slots <- struct{}{}:
+		atomic.AddInt64(&l.waiting, -1)
+	case <-timer.C:
+		atomic.AddInt64(&l.waiting, -1)
+		atomic.AddInt64(&l.rejected, 1)
+		return ErrBackendUnavailable
+	}
+	defer func() { <-l.slots }()
+
+	return fn()
+}
+
+func (l *concurrencyLimiter) status(status *AuthBackendStatus) {
+	if l == nil {
+		return
+	}
+
+	status.MaxConcurrent = cap(l.slots)
+	status.QueueDepth = atomic.LoadInt64(&l.waiting)
+	status.Rejected = atomic.LoadInt64(&l.rejected)
+}
+
+func newConcurrencyLimiter(max int, timeout time.Duration) *concurrencyLimiter {
+	return &concurrencyLimiter{
+		slots:   make(chan struct{}, max),
+		timeout: timeout,
+	}
+}
+
+// newConcurrencyLimiterFromConfig returns the limiter of the outbound calls
+// of a backend, nil if no limit is configured
+func newConcurrencyLimiterFromConfig(name string) *concurrencyLimiter {
+	max := config.GetInt("auth." + name + ".max_concurrent")
+	if max <= 0 {
+		return nil
+	}
+
+	timeout := 5
+	if config.IsSet("auth." + name + ".queue_timeout") {
+		timeout = config.GetInt("auth." + name + ".queue_timeout")
+	}
+
+	logging.GetLogger().Infof("Limiting %s authentication backend to %d concurrent calls", name, max)
+
+	return newConcurrencyLimiter(max, time.Duration(timeout)*time.Second)
+}
@@ -0,0 +1,61 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConcurrencyLimiter(t *testing.T) {
+	limiter := newConcurrencyLimiter(1, 50*time.Millisecond)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	go limiter.do(func() error {
+		close(started)
+		<-release
+		return nil
+	})
+	<-started
+
+	if err := limiter.do(func() error { return nil }); err != ErrBackendUnavailable {
+		t.Fatalf("Call exceeding the limit should be rejected, got: %v", err)
+	}
+
+	var status AuthBackendStatus
+	if limiter.status(&status); status.Rejected != 1 || status.QueueDepth != 0 {
+		t.Errorf("Wrong limiter status: %+v", status)
+	}
+
+	close(release)
+	if err := limiter.do(func() error { return nil }); err != nil {
+		t.Errorf("Call should succeed once a slot is released, got: %s", err)
+	}
+
+	// no limit
+	var nilLimiter *concurrencyLimiter
+	if err := nilLimiter.do(func() error { return nil }); err != nil {
+		t.Error(err)
+	}
+}
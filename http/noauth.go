@@ -46,6 +46,11 @@ func (h *NoAuthenticationBackend) DefaultUserRole(user string) string {
 func (b *NoAuthenticationBackend) SetDefaultUserRole(role string) {
 }
 
+// Capabilities returns the features supported by the backend
+func (h *NoAuthenticationBackend) Capabilities() AuthBackendCapabilities {
+	return AuthBackendCapabilities{}
+}
+
 func (h *NoAuthenticationBackend) Authenticate(username string, password string) (string, error) {
 	return "", nil
 }
@@ -0,0 +1,100 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// maxNonces bounds the number of pending nonces, the nonces being generated
+// for unauthenticated clients
+const maxNonces = 10000
+
+// nonceStore keeps single-use nonces for a limited time
+type nonceStore struct {
+	sync.Mutex
+	ttl    time.Duration
+	nonces map[string]time.Time
+}
+
+func (n *nonceStore) expire(now time.Time) {
+	for nonce, deadline := range n.nonces {
+		if now.After(deadline) {
+			delete(n.nonces, nonce)
+		}
+	}
+}
+
+// generate returns a new nonce
+func (n *nonceStore) generate() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	nonce := hex.EncodeToString(b)
+
+	n.Lock()
+	defer n.Unlock()
+
+	now := time.Now()
+	n.expire(now)
+
+	// evict the nonce expiring first when full
+	if len(n.nonces) >= maxNonces {
+		var oldest string
+		for pending, deadline := range n.nonces {
+			if oldest == "" || deadline.Before(n.nonces[oldest]) {
+				oldest = pending
+			}
+		}
+		delete(n.nonces, oldest)
+	}
+	n.nonces[nonce] = now.Add(n.ttl)
+
+	return nonce, nil
+}
+
+// consume returns whether the nonce is valid, a nonce can be consumed once
+func (n *nonceStore) consume(nonce string) bool {
+	n.Lock()
+	defer n.Unlock()
+
+	n.expire(time.Now())
+
+	if _, ok := n.nonces[nonce]; !ok {
+		return false
+	}
+	delete(n.nonces, nonce)
+
+	return true
+}
+
+func newNonceStore(ttl time.Duration) *nonceStore {
+	return &nonceStore{
+		ttl:    ttl,
+		nonces: make(map[string]time.Time),
+	}
+}
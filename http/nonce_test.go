@@ -0,0 +1,78 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNonceStore(t *testing.T) {
+	store := newNonceStore(50 * time.Millisecond)
+
+	nonce, err := store.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !store.consume(nonce) {
+		t.Fatal("Nonce should be valid")
+	}
+	if store.consume(nonce) {
+		t.Fatal("Nonce should not be reusable")
+	}
+
+	if nonce, err = store.generate(); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if store.consume(nonce) {
+		t.Fatal("Nonce should have expired")
+	}
+
+	if store.consume("") {
+		t.Fatal("Empty nonce should be rejected")
+	}
+}
+
+func TestNonceStoreLimit(t *testing.T) {
+	store := newNonceStore(time.Minute)
+
+	first, err := store.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < maxNonces; i++ {
+		if _, err := store.generate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(store.nonces); n > maxNonces {
+		t.Errorf("The store exceeds its limit: %d nonces", n)
+	}
+	if store.consume(first) {
+		t.Error("The oldest nonce should have been evicted")
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrBackendUnavailable is returned when an authentication backend can't
+// handle more requests or is failing
+var ErrBackendUnavailable = errors.New("Authentication backend unavailable")
+
+// AuthBackendStatus describes the state of the outbound calls of an
+// authentication backend along with its authentication counters by method
+// then outcome
+type AuthBackendStatus struct {
+	MaxConcurrent   int                         `json:",omitempty"`
+	QueueDepth      int64                       `json:",omitempty"`
+	Rejected        int64                       `json:",omitempty"`
+	Circuit         string                      `json:",omitempty"`
+	Authentications map[string]map[string]int64 `json:",omitempty"`
+}
+
+// outboundGuard protects the identity provider of a backend with a
+// concurrency limiter and a circuit breaker
+type outboundGuard struct {
+	limiter *concurrencyLimiter
+	breaker *circuitBreaker
+}
+
+var outboundGuards = struct {
+	sync.RWMutex
+	guards map[string]*outboundGuard
+}{guards: make(map[string]*outboundGuard)}
+
+// do calls fn through the circuit breaker and the limiter, a nil guard
+// always calls fn
+func (g *outboundGuard) do(fn func() error, isFailure func(error) bool) error {
+	if g == nil {
+		return fn()
+	}
+
+	return g.breaker.do(func() error { return g.limiter.do(fn) }, isFailure)
+}
+
+// newOutboundGuardFromConfig returns the guard of the outbound calls of a
+// backend, nil if neither a limit nor a circuit breaker are configured
+func newOutboundGuardFromConfig(name string) *outboundGuard {
+	limiter := newConcurrencyLimiterFromConfig(name)
+	breaker := newCircuitBreakerFromConfig(name)
+	if limiter == nil && breaker == nil {
+		return nil
+	}
+
+	guard := &outboundGuard{limiter: limiter, breaker: breaker}
+
+	outboundGuards.Lock()
+	outboundGuards.guards[name] = guard
+	outboundGuards.Unlock()
+
+	return guard
+}
+
+// GetAuthBackendsStatus returns the status of the authentication backends
+// having their outbound calls guarded or having authenticated requests
+func GetAuthBackendsStatus() map[string]AuthBackendStatus {
+	outboundGuards.RLock()
+	defer outboundGuards.RUnlock()
+
+	statuses := make(map[string]AuthBackendStatus)
+	for name, guard := range outboundGuards.guards {
+		var status AuthBackendStatus
+		guard.limiter.status(&status)
+		guard.breaker.status(&status)
+		statuses[name] = status
+	}
+
+	for name, methods := range getAuthStats() {
+		status := statuses[name]
+		status.Authentications = methods
+		statuses[name] = status
+	}
+	return statuses
+}
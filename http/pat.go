@@ -0,0 +1,404 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	auth "github.com/abbot/go-http-auth"
+	etcd "github.com/coreos/etcd/client"
+	"github.com/gorilla/mux"
+
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
+	"github.com/skydive-project/skydive/rbac"
+)
+
+const (
+	patEtcdPath      = "/auth/tokens/"
+	patTokenPrefix   = "pat."
+	patSubjectPrefix = "pat:"
+	patIDSize        = 8
+)
+
+var (
+	// ErrTokenExpired error expired personal access token
+	ErrTokenExpired = errors.New("Personal access token expired")
+	// ErrTokenScope error personal access token roles not held by its owner
+	ErrTokenScope = errors.New("Personal access token roles not held by the owner")
+)
+
+// PersonalAccessToken describes a token created by a user for automation.
+// The requests authenticated with the token are authorized as its owner
+// restricted to the roles of the token that the owner still holds.
+type PersonalAccessToken struct {
+	ID     string
+	Name   string
+	Owner  string
+	Roles  []string
+	Expiry time.Time
+	Digest string `json:",omitempty"`
+	Token  string `json:",omitempty"`
+}
+
+// PersonalAccessTokenRequest describes a token creation request, the
+// lifetime being given in seconds
+type PersonalAccessTokenRequest struct {
+	Name      string
+	Roles     []string
+	ExpiresIn int
+}
+
+// personalTokenStore keeps the personal access tokens in etcd so that they
+// are shared by all the analyzers
+type personalTokenStore struct {
+	kapi        etcd.KeysAPI
+	maxLifetime time.Duration
+}
+
+var personalTokens *personalTokenStore
+
+// InitPersonalAccessTokens enables the personal access tokens if configured
+func InitPersonalAccessTokens(kapi etcd.KeysAPI) {
+	if !config.GetBool("http.auth.personal_tokens.enabled") {
+		return
+	}
+
+	personalTokens = &personalTokenStore{
+		kapi:        kapi,
+		maxLifetime: time.Duration(config.GetInt("http.auth.personal_tokens.max_lifetime")) * time.Second,
+	}
+}
+
+// patSubject returns the RBAC subject of the requests authenticated with a
+// token, named after the owner of the token
+func patSubject(owner, id string) string {
+	return owner + "/" + patSubjectPrefix + id
+}
+
+func isPatSubject(subject string) bool {
+	return strings.Contains(subject, "/"+patSubjectPrefix)
+}
+
+func patDigest(secret string) string {
+	digest := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(digest[:])
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// validPatID returns whether an identifier has the format of the generated
+// ones, the lowercase hexadecimal encoding of patIDSize random bytes
+func validPatID(id string) bool {
+	if len(id) != 2*patIDSize {
+		return false
+	}
+	for _, c := range id {
+		if (c < '0' || c > '9') && (c < 'a' || c > 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// get returns a token, the identifiers not matching the format of the
+// generated ones being reported as not found without querying etcd
+func (p *personalTokenStore) get(id string) (*PersonalAccessToken, error) {
+	if !validPatID(id) {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound, Message: "Key not found", Cause: patEtcdPath + id}
+	}
+
+	resp, err := p.kapi.Get(context.Background(), patEtcdPath+id, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var pat PersonalAccessToken
+	if err := json.Unmarshal([]byte(resp.Node.Value), &pat); err != nil {
+		return nil, err
+	}
+	return &pat, nil
+}
+
+func (p *personalTokenStore) list(owner string) ([]*PersonalAccessToken, error) {
+	resp, err := p.kapi.Get(context.Background(), patEtcdPath, nil)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return []*PersonalAccessToken{}, nil
+		}
+		return nil, err
+	}
+
+	pats := []*PersonalAccessToken{}
+	for _, node := range resp.Node.Nodes {
+		var pat PersonalAccessToken
+		if err := json.Unmarshal([]byte(node.Value), &pat); err != nil || pat.Owner != owner {
+			continue
+		}
+		pat.Digest = ""
+		pats = append(pats, &pat)
+	}
+	return pats, nil
+}
+
+// create registers a new token, its roles have to be held by the owner
+func (p *personalTokenStore) create(owner string, request *PersonalAccessTokenRequest) (*PersonalAccessToken, error) {
+	ownerRoles := rbac.GetUserRoles(owner)
+
+	roles := request.Roles
+	if len(roles) == 0 {
+		roles = ownerRoles
+	}
+	if len(roles) == 0 || !isSubset(roles, ownerRoles) {
+		return nil, ErrTokenScope
+	}
+
+	lifetime := time.Duration(request.ExpiresIn) * time.Second
+	if lifetime <= 0 || (p.maxLifetime > 0 && lifetime > p.maxLifetime) {
+		lifetime = p.maxLifetime
+	}
+
+	id, err := randomHex(patIDSize)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return nil, err
+	}
+
+	pat := &PersonalAccessToken{
+		ID:     id,
+		Name:   request.Name,
+		Owner:  owner,
+		Roles:  roles,
+		Digest: patDigest(secret),
+	}
+	if lifetime > 0 {
+		pat.Expiry = time.Now().Add(lifetime).UTC()
+	}
+
+	data, err := json.Marshal(pat)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts *etcd.SetOptions
+	if lifetime > 0 {
+		opts = &etcd.SetOptions{TTL: lifetime}
+	}
+	if _, err := p.kapi.Set(context.Background(), patEtcdPath+id, string(data), opts); err != nil {
+		return nil, err
+	}
+
+	pat.Digest = ""
+	pat.Token = patTokenPrefix + id + "." + secret
+	return pat, nil
+}
+
+func (p *personalTokenStore) revoke(owner, id string) error {
+	pat, err := p.get(id)
+	if err != nil {
+		return err
+	}
+	if pat.Owner != owner {
+		return ErrWrongCredentials
+	}
+
+	if _, err := p.kapi.Delete(context.Background(), patEtcdPath+id, nil); err != nil {
+		return err
+	}
+	rbac.RemoveSubjectScope(patSubject(pat.Owner, id))
+
+	return nil
+}
+
+// check validates a token and returns the RBAC subject of its requests. The
+// subject is scoped to the owner restricted to the roles of the token still
+// held by the owner, the scope expiring with the token.
+func (p *personalTokenStore) check(backend AuthenticationBackend, token string) (string, error) {
+	s := strings.SplitN(strings.TrimPrefix(token, patTokenPrefix), ".", 2)
+	if len(s) != 2 {
+		return "", ErrWrongCredentials
+	}
+	id, secret := s[0], s[1]
+
+	pat, err := p.get(id)
+	if err != nil {
+		if etcd.IsKeyNotFound(err) {
+			return "", ErrWrongCredentials
+		}
+		return "", err
+	}
+
+	if subtle.ConstantTimeCompare([]byte(patDigest(secret)), []byte(pat.Digest)) != 1 {
+		return "", ErrWrongCredentials
+	}
+	if !pat.Expiry.IsZero() && time.Now().After(pat.Expiry) {
+		return "", ErrTokenExpired
+	}
+
+	provisionRole(backend, pat.Owner)
+	ownerRoles := rbac.GetUserRoles(pat.Owner)
+
+	var roles []string
+	for _, role := range pat.Roles {
+		if isSubset([]string{role}, ownerRoles) {
+			roles = append(roles, role)
+		}
+	}
+	if len(roles) == 0 {
+		return "", ErrTokenScope
+	}
+
+	subject := patSubject(pat.Owner, id)
+	rbac.SetSubjectScope(subject, pat.Owner, roles, pat.Expiry)
+
+	return subject, nil
+}
+
+// authenticateRequest authenticates a request carrying a personal access
+// token as bearer token, returns false for any other request
+func (p *personalTokenStore) authenticateRequest(backend AuthenticationBackend, r *http.Request) (string, bool, error) {
+	if p == nil {
+		return "", false, nil
+	}
+
+	token, ok := bearerToken(requestAuthorization(r))
+	if !ok || !strings.HasPrefix(token, patTokenPrefix) {
+		return "", false, nil
+	}
+
+	subject, err := p.check(backend, token)
+	if err != nil {
+		logging.GetLogger().Warningf("Personal access token rejected from %s: %s", r.RemoteAddr, err)
+	}
+	return subject, true, err
+}
+
+func isSubset(roles, of []string) bool {
+	sorted := append([]string{}, of...)
+	sort.Strings(sorted)
+
+	for _, role := range roles {
+		if i := sort.SearchStrings(sorted, role); i == len(sorted) || sorted[i] != role {
+			return false
+		}
+	}
+	return true
+}
+
+// RegisterPersonalAccessTokenRoutes registers the endpoints managing the
+// personal access tokens of the authenticated user
+func (s *Server) RegisterPersonalAccessTokenRoutes(authBackend AuthenticationBackend) {
+	if personalTokens == nil {
+		return
+	}
+
+	s.Router.HandleFunc("/auth/tokens", authBackend.Wrap(s.serveListPersonalAccessTokens)).Methods("GET")
+	s.Router.HandleFunc("/auth/tokens", authBackend.Wrap(s.serveCreatePersonalAccessToken)).Methods("POST")
+	s.Router.HandleFunc("/auth/tokens/{id}", authBackend.Wrap(s.serveRevokePersonalAccessToken)).Methods("DELETE")
+}
+
+func writePersonalAccessTokenResponse(w http.ResponseWriter, status int, response interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.GetLogger().Warningf("Error while writing personal access token response: %s", err)
+	}
+}
+
+func (s *Server) serveListPersonalAccessTokens(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	setTLSHeader(w, &r.Request)
+	setNoStoreHeaders(w)
+
+	pats, err := personalTokens.list(r.Username)
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to list personal access tokens: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	writePersonalAccessTokenResponse(w, http.StatusOK, pats)
+}
+
+func (s *Server) serveCreatePersonalAccessToken(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	setTLSHeader(w, &r.Request)
+	setNoStoreHeaders(w)
+
+	// a token can't be used to create other tokens
+	if isPatSubject(r.Username) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	var request PersonalAccessTokenRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.Name == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+
+	pat, err := personalTokens.create(r.Username, &request)
+	switch err {
+	case nil:
+		logging.GetLogger().Infof("User %s created personal access token %s (%s) with roles %s", r.Username, pat.ID, pat.Name, pat.Roles)
+		writePersonalAccessTokenResponse(w, http.StatusCreated, pat)
+	case ErrTokenScope:
+		w.WriteHeader(http.StatusForbidden)
+	default:
+		logging.GetLogger().Errorf("Unable to create personal access token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (s *Server) serveRevokePersonalAccessToken(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	setTLSHeader(w, &r.Request)
+
+	id := mux.Vars(&r.Request)["id"]
+	switch err := personalTokens.revoke(r.Username, id); {
+	case err == nil:
+		logging.GetLogger().Infof("User %s revoked personal access token %s", r.Username, id)
+		w.WriteHeader(http.StatusNoContent)
+	case err == ErrWrongCredentials || etcd.IsKeyNotFound(err):
+		w.WriteHeader(http.StatusNotFound)
+	default:
+		logging.GetLogger().Errorf("Unable to revoke personal access token: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
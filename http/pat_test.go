@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"testing"
+
+	etcd "github.com/coreos/etcd/client"
+)
+
+func TestPersonalAccessTokenRoles(t *testing.T) {
+	if !isSubset([]string{"guest"}, []string{"admin", "guest"}) {
+		t.Error("guest should be a subset of admin and guest")
+	}
+	if isSubset([]string{"admin"}, []string{"guest"}) {
+		t.Error("admin shouldn't be a subset of guest")
+	}
+
+	// the owner of a token can't get roles it doesn't hold
+	store := &personalTokenStore{}
+	if _, err := store.create("user1", &PersonalAccessTokenRequest{Name: "ci", Roles: []string{"admin"}}); err != ErrTokenScope {
+		t.Errorf("Expected %s, got %v", ErrTokenScope, err)
+	}
+
+	if _, err := store.check(NewNoAuthenticationBackend(), patTokenPrefix+"malformed"); err != ErrWrongCredentials {
+		t.Errorf("Expected %s for a malformed token, got %v", ErrWrongCredentials, err)
+	}
+
+	// the identifiers are validated before querying etcd, the store having
+	// no etcd client
+	for _, id := range []string{"", "../sessions", "0123456789ABCDEF", "0123456789abcde", "0123456789abcdef0"} {
+		if _, err := store.check(NewNoAuthenticationBackend(), patTokenPrefix+id+".secret"); err != ErrWrongCredentials {
+			t.Errorf("Expected %s for the identifier %q, got %v", ErrWrongCredentials, id, err)
+		}
+		if err := store.revoke("user1", id); !etcd.IsKeyNotFound(err) {
+			t.Errorf("Expected a not found error when revoking %q, got %v", id, err)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/skydive-project/skydive/config"
+)
+
+const hibpRangeURL = "https://api.pwnedpasswords.com/range/"
+
+// PasswordChecker checks whether a password is known to be compromised
+type PasswordChecker interface {
+	Compromised(password string) (bool, error)
+}
+
+// HIBPPasswordChecker checks the passwords against the HaveIBeenPwned range
+// API. Only the first 5 characters of the SHA-1 hash of the password are
+// sent, the matching is done locally on the returned suffixes.
+type HIBPPasswordChecker struct {
+	URL    string
+	client *http.Client
+}
+
+// Compromised returns whether the password appears in a breach
+func (h *HIBPPasswordChecker) Compromised(password string) (bool, error) {
+	digest := sha1.Sum([]byte(password))
+	hash := strings.ToUpper(hex.EncodeToString(digest[:]))
+	prefix, suffix := hash[:5], hash[5:]
+
+	resp, err := h.client.Get(h.URL + prefix)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("Unexpected status from %s: %s", h.URL, resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		s := strings.SplitN(strings.TrimSpace(scanner.Text()), ":", 2)
+		if strings.EqualFold(s[0], suffix) {
+			return true, nil
+		}
+	}
+	return false, scanner.Err()
+}
+
+// NewHIBPPasswordChecker returns a checker using the given range API URL
+func NewHIBPPasswordChecker(url string) *HIBPPasswordChecker {
+	return &HIBPPasswordChecker{URL: url, client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+var (
+	passwordChecker     PasswordChecker
+	passwordCheckerOnce sync.Once
+	passwordCheckerLock sync.RWMutex
+)
+
+// SetPasswordChecker replaces the checker of the compromised passwords, a nil
+// checker disabling the check
+func SetPasswordChecker(checker PasswordChecker) {
+	passwordCheckerOnce.Do(func() {})
+
+	passwordCheckerLock.Lock()
+	passwordChecker = checker
+	passwordCheckerLock.Unlock()
+}
+
+// checkCompromised checks the password with the checker before the deadline,
+// a zero deadline leaving only the timeout of the checker. A check exceeding
+// the deadline is reported as an error.
+func checkCompromised(checker PasswordChecker, password string, deadline time.Time) (bool, error) {
+	if deadline.IsZero() {
+		return checker.Compromised(password)
+	}
+
+	timeout := time.Until(deadline)
+	if timeout <= 0 {
+		return false, errors.New("No time left to check the password")
+	}
+
+	type result struct {
+		compromised bool
+		err         error
+	}
+	done := make(chan result, 1)
+	go func() {
+		compromised, err := checker.Compromised(password)
+		done <- result{compromised: compromised, err: err}
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		return res.compromised, res.err
+	case <-timer.C:
+		return false, errors.New("Password check exceeded the authentication timeout")
+	}
+}
+
+// getPasswordChecker returns the configured checker, nil if disabled
+func getPasswordChecker() PasswordChecker {
+	passwordCheckerOnce.Do(func() {
+		if config.GetBool("http.auth.compromised_passwords.enabled") {
+			url := config.GetString("http.auth.compromised_passwords.url")
+			if url == "" {
+				url = hibpRangeURL
+			}
+			passwordChecker = NewHIBPPasswordChecker(url)
+		}
+	})
+
+	passwordCheckerLock.RLock()
+	defer passwordCheckerLock.RUnlock()
+	return passwordChecker
+}
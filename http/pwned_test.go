@@ -0,0 +1,90 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHIBPPasswordChecker(t *testing.T) {
+	digest := sha1.Sum([]byte("password"))
+	hash := strings.ToUpper(hex.EncodeToString(digest[:]))
+
+	var requested string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requested = r.URL.Path
+		fmt.Fprintf(w, "0018A45C4D1DEF81644B54AB7F969B88D65:1\r\n%s:3730471\r\n", hash[5:])
+	}))
+	defer server.Close()
+
+	checker := NewHIBPPasswordChecker(server.URL + "/range/")
+
+	compromised, err := checker.Compromised("password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !compromised {
+		t.Error("The password should be reported as compromised")
+	}
+	if requested != "/range/"+hash[:5] {
+		t.Errorf("Only the hash prefix should be sent, got %s", requested)
+	}
+
+	if compromised, err = checker.Compromised("Zk3#t9!qW2vL"); err != nil || compromised {
+		t.Errorf("The password shouldn't be reported as compromised: %v", err)
+	}
+}
+
+// slowPasswordChecker never answers before being released
+type slowPasswordChecker struct {
+	release chan struct{}
+}
+
+func (c *slowPasswordChecker) Compromised(password string) (bool, error) {
+	<-c.release
+	return true, nil
+}
+
+func TestCheckCompromisedDeadline(t *testing.T) {
+	checker := &slowPasswordChecker{release: make(chan struct{})}
+	defer close(checker.release)
+
+	start := time.Now()
+	if _, err := checkCompromised(checker, "password", start.Add(100*time.Millisecond)); err == nil {
+		t.Error("The check should fail once the deadline exceeded")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("The check should have been abandoned at the deadline, took %s", elapsed)
+	}
+
+	if _, err := checkCompromised(checker, "password", start.Add(-time.Second)); err == nil {
+		t.Error("The check shouldn't be done once the deadline passed")
+	}
+}
@@ -25,14 +25,17 @@ package http
 import (
 	"context"
 	"crypto/tls"
+	"encoding/json"
 	"fmt"
 	"html/template"
+	"io"
 	"io/ioutil"
 	"mime"
 	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -68,8 +71,40 @@ const (
 
 	// ExtraAssetPrefix is used for extra assets
 	ExtraAssetPrefix = "/extra-statics"
+
+	// maxLoginBodySize is the maximum size of a JSON login request
+	maxLoginBodySize = 64 * 1024
 )
 
+// LoginRequest holds the credentials submitted to the login endpoint
+type LoginRequest struct {
+	Username    string
+	Password    string
+	Nonce       string
+	Permissions bool
+	json        bool
+}
+
+// LoginResponse is the body returned by the login endpoint when requested or
+// when the password of the user has to be changed
+type LoginResponse struct {
+	Token               string            `json:",omitempty"`
+	Permissions         []rbac.Permission `json:",omitempty"`
+	PasswordExpired     bool              `json:",omitempty"`
+	PasswordCompromised bool              `json:",omitempty"`
+	AccessLevel         string            `json:",omitempty"`
+}
+
+// WhoAmI describes the authenticated user
+type WhoAmI struct {
+	Username    string
+	Roles       []string
+	Permissions []rbac.Permission
+	Backend     string `json:",omitempty"`
+	Realm       string `json:",omitempty"`
+	AccessLevel string `json:",omitempty"`
+}
+
 type ExtraAsset struct {
 	Filename string
 	Ext      string
@@ -91,11 +126,35 @@ type Server struct {
 	wg          sync.WaitGroup
 	extraAssets map[string]ExtraAsset
 	globalVars  map[string]interface{}
+	loginNonces *nonceStore
+}
+
+// credentialContextKeys are the request context keys never copied into the
+// authenticated request as they may hold authentication material
+var credentialContextKeys = []string{"authorization", "credentials", "password", "secret", "token"}
+
+// redactedContextKey returns whether a request context key must not be
+// copied, the keys being matched by name without case sensitivity
+func redactedContextKey(key interface{}) bool {
+	name, ok := key.(string)
+	if !ok {
+		return false
+	}
+
+	for _, redacted := range append(credentialContextKeys, config.GetStringSlice("http.auth.redacted_context_keys")...) {
+		if strings.EqualFold(name, redacted) {
+			return true
+		}
+	}
+	return false
 }
 
 func copyRequestVars(old, new *http.Request) {
 	kv := gcontext.GetAll(old)
 	for k, v := range kv {
+		if redactedContextKey(k) {
+			continue
+		}
 		gcontext.Set(new, k, v)
 	}
 }
@@ -124,7 +183,27 @@ func (s *Server) RegisterRoutes(routes []Route, auth AuthenticationBackend) {
 }
 
 func (s *Server) RegisterLoginRoute(authBackend AuthenticationBackend) {
+	if config.GetBool("http.auth.login_nonce.enabled") {
+		s.loginNonces = newNonceStore(time.Duration(config.GetInt("http.auth.login_nonce.ttl")) * time.Second)
+		s.Router.HandleFunc("/login/nonce", s.serveLoginNonce).Methods("GET")
+	}
 	s.Router.HandleFunc("/login", s.serveLoginHandlerFunc(authBackend))
+	s.Router.HandleFunc("/logout", s.serveLogoutHandlerFunc(authBackend)).Methods("POST")
+}
+
+// RegisterWhoAmIRoute registers the endpoint returning the authenticated user
+// along with its roles and permissions, or only its access level when the
+// minimal disclosure is enabled
+func (s *Server) RegisterWhoAmIRoute(authBackend AuthenticationBackend) {
+	s.Router.HandleFunc("/whoami", authBackend.Wrap(s.serveWhoAmI)).Methods("GET")
+}
+
+// RegisterAuthBackendsRoute registers the endpoint returning the capabilities
+// and the branding of the authentication backends, and the one returning
+// only their branding which is reachable before login
+func (s *Server) RegisterAuthBackendsRoute(authBackend AuthenticationBackend) {
+	s.Router.HandleFunc("/auth/backends", authBackend.Wrap(s.serveAuthBackends)).Methods("GET")
+	s.Router.HandleFunc("/auth/branding", s.serveAuthBranding).Methods("GET")
 }
 
 func (s *Server) Listen() error {
@@ -244,7 +323,7 @@ func (s *Server) ServeIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest)
 	}{
 		ExtraAssets: s.extraAssets,
 		GlobalVars:  s.globalVars,
-		Permissions: rbac.GetPermissionsForUser(username),
+		Permissions: disclosedPermissions(username),
 	}
 
 	w.Header().Set("Content-Type", "text/html; charset=UTF-8")
@@ -260,23 +339,143 @@ func (s *Server) ServeIndex(w http.ResponseWriter, r *auth.AuthenticatedRequest)
 	}
 }
 
+// serveLoginNonce returns a single-use nonce that has to be submitted along
+// with the credentials to the login endpoint
+func (s *Server) serveLoginNonce(w http.ResponseWriter, r *http.Request) {
+	setTLSHeader(w, r)
+	setNoStoreHeaders(w)
+
+	nonce, err := s.loginNonces.generate()
+	if err != nil {
+		logging.GetLogger().Errorf("Unable to generate login nonce: %s", err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(struct{ Nonce string }{Nonce: nonce}); err != nil {
+		logging.GetLogger().Warningf("Error while writing login nonce: %s", err)
+	}
+}
+
 func (s *Server) serveLogin(w http.ResponseWriter, r *http.Request, authBackend AuthenticationBackend) {
 	setTLSHeader(w, r)
+	setNoStoreHeaders(w)
+	normalizeRequestCookies(r)
+
 	if r.Method == "POST" {
-		r.ParseForm()
-		loginForm, passwordForm := r.Form["username"], r.Form["password"]
-		if len(loginForm) != 0 && len(passwordForm) != 0 {
-			username, password := loginForm[0], passwordForm[0]
+		login, status, err := readLoginRequest(r)
+		if err != nil {
+			logging.GetLogger().Warningf("Invalid login request from %s: %s", r.RemoteAddr, err)
+			w.WriteHeader(status)
+			return
+		}
 
-			if _, err := authenticate(authBackend, w, username, password); err == nil {
-				w.WriteHeader(http.StatusOK)
+		if !basicAllowedAddress(authBackend, r) {
+			recordAuthentication(authBackend.Name(), authMethodLogin, authOutcomeFailure)
+			unauthorized(w, r)
+			return
+		}
+
+		// reject replayed login requests
+		if s.loginNonces != nil && !s.loginNonces.consume(login.Nonce) {
+			logging.GetLogger().Warningf("Login request with an invalid or reused nonce from %s", r.RemoteAddr)
+			unauthorized(w, r)
+			return
+		}
+
+		if login.Username != "" && login.Password != "" {
+			username, password := login.Username, login.Password
+
+			// the password check counts against the total timeout
+			var deadline time.Time
+			if timeout := config.GetInt("http.auth.total_timeout"); timeout > 0 {
+				deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+			}
+
+			var id string
+			token, _, err := authenticateWithTimeout(w, r, func(w http.ResponseWriter, r *http.Request) (string, error) {
+				// the session identifier is handed to the client in place
+				// of the backend token when a session is opened
+				token, session, err := authenticateSession(r.Context(), authBackend, w, username, password, true)
+				if session != "" {
+					id = session
+					return session, err
+				}
+				return token, err
+			})
+			recordAuthentication(authBackend.Name(), authMethodLogin, authOutcome(err))
+
+			if err == nil {
+				notifyAuthEvent(AuthEventLogin, username, authBackend, r)
+
+				// end the session set before the login, a new one being
+				// opened, on all the analyzers sharing the session store
+				if cookie, err := r.Cookie(tokenName); err == nil && cookie.Value != token {
+					sessions.end(cookie.Value)
+				}
 
 				roles := rbac.GetUserRoles(username)
 				logging.GetLogger().Infof("User %s authenticated with %s backend with roles %s", username, authBackend.Name(), roles)
+
+				response := &LoginResponse{}
+				if checker, ok := authBackend.(passwordExpiryChecker); ok && checker.PasswordExpired(username) {
+					logging.GetLogger().Warningf("Password of user %s expired, it has to be changed", username)
+					response.PasswordExpired = true
+				}
+
+				// advisory only, there is no password change endpoint
+				if checker := getPasswordChecker(); checker != nil {
+					if compromised, err := checkCompromised(checker, password, deadline); err != nil {
+						logging.GetLogger().Warningf("Unable to check whether the password of user %s is compromised: %s", username, err)
+					} else if compromised {
+						logging.GetLogger().Warningf("User %s logged in with a known compromised password", username)
+						response.PasswordCompromised = true
+					}
+				}
+
+				// clients not handling cookies can ask for the permissions in the body
+				if login.Permissions {
+					if minimalDisclosure() {
+						response.AccessLevel = rbac.GetAccessLevelForUser(username)
+					} else {
+						response.Permissions = rbac.GetPermissionsForUser(username)
+					}
+				}
+
+				// JSON clients get the token in the body, usable as a bearer
+				// token. The tokens holding the credentials of the user are
+				// never returned, only the identifier of their session.
+				if _, credentials := authBackend.(credentialTokenIssuer); login.json && (id != "" || !credentials) {
+					response.Token = token
+				}
+
+				// the clients asking for the permissions get a response
+				// even without any permission
+				if login.json || login.Permissions || response.PasswordExpired || response.PasswordCompromised {
+					writeLoginResponse(w, response)
+					return
+				}
+
+				w.WriteHeader(http.StatusOK)
 				return
 			}
 
-			unauthorized(w, r)
+			if err == ErrPasswordExpired {
+				notifyAuthEvent(AuthEventLockout, username, authBackend, r)
+			} else {
+				notifyAuthEvent(AuthEventLoginFailure, username, authBackend, r)
+			}
+
+			switch err {
+			case ErrBackendUnavailable:
+				backendUnavailable(w, r)
+			case ErrAuthTimeout:
+				authTimeout(w, r)
+			default:
+				unauthorized(w, r)
+			}
 		} else {
 			unauthorized(w, r)
 		}
@@ -285,6 +484,144 @@ func (s *Server) serveLogin(w http.ResponseWriter, r *http.Request, authBackend
 	}
 }
 
+// readLoginRequest returns the credentials of a login request, submitted as
+// a form or as a JSON body. The status to reply with is returned on error.
+func readLoginRequest(r *http.Request) (*LoginRequest, int, error) {
+	if mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type")); mediaType == "application/json" {
+		body, err := ioutil.ReadAll(io.LimitReader(r.Body, maxLoginBodySize+1))
+		if err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		if len(body) > maxLoginBodySize {
+			return nil, http.StatusRequestEntityTooLarge, fmt.Errorf("body larger than %d bytes", maxLoginBodySize)
+		}
+
+		login := &LoginRequest{json: true}
+		if err := json.Unmarshal(body, login); err != nil {
+			return nil, http.StatusBadRequest, err
+		}
+		return login, 0, nil
+	}
+
+	r.ParseForm()
+
+	withPerms, _ := strconv.ParseBool(r.Form.Get("permissions"))
+	return &LoginRequest{
+		Username:    r.Form.Get("username"),
+		Password:    r.Form.Get("password"),
+		Nonce:       r.Form.Get("nonce"),
+		Permissions: withPerms,
+	}, 0, nil
+}
+
+func writeLoginResponse(w http.ResponseWriter, response *LoginResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.GetLogger().Warningf("Error while writing login response: %s", err)
+	}
+}
+
+func (s *Server) serveWhoAmI(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	setTLSHeader(w, &r.Request)
+	setNoStoreHeaders(w)
+
+	whoami := &WhoAmI{Username: r.Username}
+	if minimalDisclosure() {
+		whoami.AccessLevel = rbac.GetAccessLevelForUser(r.Username)
+	} else {
+		whoami.Roles = rbac.GetUserRoles(r.Username)
+		whoami.Permissions = rbac.GetPermissionsForUser(r.Username)
+	}
+	if info := GetSessionInfo(&r.Request); info != nil {
+		whoami.Backend, whoami.Realm = info.Backend, info.Realm
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(whoami); err != nil {
+		logging.GetLogger().Warningf("Error while writing whoami response: %s", err)
+	}
+}
+
+// serveLogout terminates a session or revokes a token. The session
+// identifier or the token has to be passed as a bearer token, which can't be
+// done by a cross-site request. The token is revoked by the backend when
+// supported, a revocation failure doesn't prevent the local logout. The
+// cookies are cleared when they hold the revoked session.
+func (s *Server) serveLogout(w http.ResponseWriter, r *http.Request, authBackend AuthenticationBackend) {
+	setTLSHeader(w, r)
+	setNoStoreHeaders(w)
+	normalizeRequestCookies(r)
+
+	presented, ok := bearerToken(requestAuthorization(r))
+	if !ok {
+		unauthorized(w, r)
+		return
+	}
+
+	backend, token := sessions.end(presented)
+	if backend == "" {
+		// not a session, the token of the backend itself, unless it holds
+		// the credentials of the user
+		if _, ok := authBackend.(credentialTokenIssuer); ok {
+			unauthorized(w, r)
+			return
+		}
+		backend, token = authBackend.Name(), presented
+	}
+
+	if backend == authBackend.Name() && token != "" {
+		var username string
+		if checker, ok := authBackend.(tokenChecker); ok {
+			if username, _ = checker.CheckUser(token); username == "" && token == presented {
+				unauthorized(w, r)
+				return
+			}
+		}
+		notifyAuthEvent(AuthEventLogout, username, authBackend, r)
+
+		if revoker, ok := authBackend.(tokenRevoker); ok {
+			if err := revoker.Revoke(token); err != nil {
+				logging.GetLogger().Warningf("Failed to revoke token with %s backend: %s", authBackend.Name(), err)
+			}
+		}
+	}
+
+	if cookie, err := r.Cookie(tokenName); err != nil || cookie.Value == presented {
+		for _, name := range []string{tokenName, "permissions", permissionsVersionCookie} {
+			http.SetCookie(w, &http.Cookie{Name: name, Path: "/", MaxAge: -1})
+		}
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func (s *Server) serveAuthBackends(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
+	setTLSHeader(w, &r.Request)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(GetAuthBackendsInfo()); err != nil {
+		logging.GetLogger().Warningf("Error while writing auth backends response: %s", err)
+	}
+}
+
+func (s *Server) serveAuthBranding(w http.ResponseWriter, r *http.Request) {
+	setTLSHeader(w, r)
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(GetAuthBackendsBranding()); err != nil {
+		logging.GetLogger().Warningf("Error while writing auth branding response: %s", err)
+	}
+}
+
+func (s *Server) serveLogoutHandlerFunc(authBackend AuthenticationBackend) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.serveLogout(w, r, authBackend)
+	}
+}
+
 func (s *Server) serveLoginHandlerFunc(authBackend AuthenticationBackend) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		s.serveLogin(w, r, authBackend)
@@ -296,16 +633,34 @@ func unauthorized(w http.ResponseWriter, r *http.Request) {
 	w.Write([]byte("401 Unauthorized\n"))
 }
 
+func backendUnavailable(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusServiceUnavailable)
+	w.Write([]byte("503 Service Unavailable\n"))
+}
+
+// setNoStoreHeaders prevents the caching of responses carrying credentials or
+// session information by the clients and the intermediaries
+func setNoStoreHeaders(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Pragma", "no-cache")
+}
+
+func authTimeout(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusGatewayTimeout)
+	w.Write([]byte("504 Gateway Timeout\n"))
+}
+
 // HandleFunc specifies the handler function and the authentication backend used for a given path
 func (s *Server) HandleFunc(path string, f auth.AuthenticatedHandlerFunc, authBackend AuthenticationBackend) {
 	postAuthHandler := func(w http.ResponseWriter, r *auth.AuthenticatedRequest) {
 		// re-add user to its group
-		if roles := rbac.GetUserRoles(r.Username); len(roles) == 0 {
-			rbac.AddRoleForUser(r.Username, authBackend.DefaultUserRole(r.Username))
-		}
+		provisionRole(authBackend, r.Username)
 
-		// re-send the permissions
-		setPermissionsCookie(w, r.Username)
+		// re-send the permissions, only the stale ones being refreshed, by
+		// authCallWrapped, when the refresh is enabled
+		if !config.GetBool("http.auth.permissions_refresh") {
+			setPermissionsCookie(w, r.Username)
+		}
 
 		f(w, r)
 	}
@@ -399,6 +754,11 @@ func NewServerFromConfig(serviceType common.ServiceType) (*Server, error) {
 		return nil, fmt.Errorf("Configuration error: %s", err)
 	}
 
+	// the break-glass account authenticates on every backend of the server
+	if err := initBreakGlassAccount(); err != nil {
+		return nil, err
+	}
+
 	host := config.GetString("host_id")
 	assets := config.GetString("ui.extra_assets")
 
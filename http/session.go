@@ -0,0 +1,385 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"time"
+
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
+	"github.com/skydive-project/skydive/rbac"
+)
+
+const (
+	sessionEtcdPath = "/auth/sessions/"
+
+	// sessionIdleTTL is the inactivity after which a session without idle
+	// timeout is removed from the store
+	sessionIdleTTL = 24 * time.Hour
+
+	// sessionTouchInterval is the maximum interval between two records of
+	// the last use of a session, reduced to a tenth of its idle timeout
+	sessionTouchInterval = 30 * time.Second
+)
+
+var errNoSessionStore = errors.New("No session store")
+
+// SessionInfo describes the backend and the realm a session was opened with
+type SessionInfo struct {
+	Backend string
+	Realm   string
+}
+
+// realmProvider is implemented by the backends authenticating users of a
+// specific realm
+type realmProvider interface {
+	Realm() string
+}
+
+// session is a session opened by an authentication, identified by a random
+// identifier sent in the cookie in place of the token issued by the backend.
+// The token is stored sealed with a key derived from the identifier. The
+// zero timeout means no idle timeout.
+type session struct {
+	SessionInfo
+	Sealed  []byte `json:",omitempty"`
+	Issued  time.Time
+	Used    time.Time
+	Timeout time.Duration
+	token   string
+}
+
+// expiration returns the end of the lifetime of the session, counted from the
+// time it was issued, or the zero time without lifetime
+func (s *session) expiration(lifetime time.Duration) time.Time {
+	if lifetime > 0 {
+		return s.Issued.Add(lifetime)
+	}
+	return time.Time{}
+}
+
+func (s *session) expired(now time.Time, lifetime time.Duration) bool {
+	if s.Timeout > 0 && now.After(s.Used.Add(s.Timeout)) {
+		return true
+	}
+	expiration := s.expiration(lifetime)
+	return !expiration.IsZero() && now.After(expiration)
+}
+
+// cookieTimeout returns the idle timeout of the session reduced to its
+// remaining lifetime, the Max-Age of its cookie
+func (s *session) cookieTimeout(now time.Time, lifetime time.Duration) time.Duration {
+	if expiration := s.expiration(lifetime); !expiration.IsZero() {
+		if remaining := expiration.Sub(now); s.Timeout <= 0 || remaining < s.Timeout {
+			return remaining
+		}
+	}
+	return s.Timeout
+}
+
+// ttl returns the time the session is kept in the store without being used
+func (s *session) ttl(now time.Time, lifetime time.Duration) time.Duration {
+	ttl := s.cookieTimeout(now, lifetime)
+	if ttl <= 0 || ttl > sessionIdleTTL {
+		ttl = sessionIdleTTL
+	}
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+// sessionStore keeps the sessions opened by an authentication in etcd so
+// that they are shared by all the analyzers and kept across restarts. The
+// sessions are stored by digest of their identifier, a session is rejected
+// once idle for too long, past its maximum lifetime or ended.
+type sessionStore struct {
+	kapi etcd.KeysAPI
+}
+
+var sessions *sessionStore
+
+// InitSessions keeps the sessions opened by the logins in etcd. Without
+// session store, the authentication cookie holds the token issued by the
+// backend.
+func InitSessions(kapi etcd.KeysAPI) {
+	sessions = &sessionStore{kapi: kapi}
+}
+
+func newSessionID() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func sessionEtcdKey(id string) string {
+	digest := sha256.Sum256([]byte(id))
+	return sessionEtcdPath + hex.EncodeToString(digest[:])
+}
+
+// sessionCipher returns the cipher sealing the token of a session with a key
+// derived from the session identifier, that only the client holds
+func sessionCipher(id string) (cipher.AEAD, error) {
+	key := sha256.Sum256([]byte("token:" + id))
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealSessionToken(id, token string) ([]byte, error) {
+	aead, err := sessionCipher(id)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, []byte(token), nil), nil
+}
+
+func openSessionToken(id string, sealed []byte) (string, error) {
+	aead, err := sessionCipher(id)
+	if err != nil {
+		return "", err
+	}
+
+	if len(sealed) < aead.NonceSize() {
+		return "", errors.New("Sealed token too short")
+	}
+	token, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+	if err != nil {
+		return "", err
+	}
+	return string(token), nil
+}
+
+// put records a session, only if it wasn't ended when updating it
+func (s *sessionStore) put(id string, session *session, update bool) error {
+	var err error
+	if session.Sealed, err = sealSessionToken(id, session.token); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+
+	opts := &etcd.SetOptions{TTL: session.ttl(time.Now(), sessionLifetime())}
+	if update {
+		opts.PrevExist = etcd.PrevExist
+	}
+	_, err = s.kapi.Set(context.Background(), sessionEtcdKey(id), string(data), opts)
+	return err
+}
+
+// start opens a new session for the token issued by a backend and returns
+// the identifier of the session along with the timeout of its cookie
+func (s *sessionStore) start(info *SessionInfo, token string, timeout time.Duration) (string, time.Duration, error) {
+	if s == nil {
+		return "", 0, errNoSessionStore
+	}
+
+	id, err := newSessionID()
+	if err != nil {
+		return "", 0, err
+	}
+
+	now := time.Now()
+	session := &session{SessionInfo: *info, Issued: now, Used: now, Timeout: timeout, token: token}
+	if err := s.put(id, session, false); err != nil {
+		return "", 0, err
+	}
+
+	return id, session.cookieTimeout(now, sessionLifetime()), nil
+}
+
+// load returns a session of the store, expired or not
+func (s *sessionStore) load(id string) (*session, bool) {
+	if s == nil || id == "" {
+		return nil, false
+	}
+
+	resp, err := s.kapi.Get(context.Background(), sessionEtcdKey(id), nil)
+	if err != nil {
+		if !etcd.IsKeyNotFound(err) {
+			logging.GetLogger().Errorf("Unable to retrieve session: %s", err)
+		}
+		return nil, false
+	}
+
+	var session session
+	if err := json.Unmarshal([]byte(resp.Node.Value), &session); err != nil {
+		return nil, false
+	}
+
+	if session.token, err = openSessionToken(id, session.Sealed); err != nil {
+		logging.GetLogger().Errorf("Unable to open the token of a session: %s", err)
+		return nil, false
+	}
+
+	return &session, true
+}
+
+// get returns an active session, an expired session is removed so that it
+// keeps being rejected
+func (s *sessionStore) get(id string) (*session, bool) {
+	session, ok := s.load(id)
+	if !ok {
+		return nil, false
+	}
+
+	if session.expired(time.Now(), sessionLifetime()) {
+		s.kapi.Delete(context.Background(), sessionEtcdKey(id), nil)
+		return nil, false
+	}
+
+	return session, true
+}
+
+// lookup returns an active session opened with the backend
+func (s *sessionStore) lookup(backend, id string) (*session, bool) {
+	session, ok := s.get(id)
+	if !ok || session.Backend != backend {
+		return nil, false
+	}
+	return session, true
+}
+
+// touch records the use of a session and its idle timeout, returns the
+// timeout of its cookie when recorded. The last use is only recorded once
+// in a while to spare the store.
+func (s *sessionStore) touch(id string, timeout time.Duration) (time.Duration, bool) {
+	session, ok := s.get(id)
+	if !ok {
+		return 0, false
+	}
+
+	interval := sessionTouchInterval
+	if timeout > 0 && timeout/10 < interval {
+		interval = timeout / 10
+	}
+
+	now := time.Now()
+	if now.Sub(session.Used) < interval && session.Timeout == timeout {
+		return 0, false
+	}
+
+	session.Used, session.Timeout = now, timeout
+	if err := s.put(id, session, true); err != nil {
+		if !etcd.IsKeyNotFound(err) {
+			logging.GetLogger().Errorf("Unable to record the use of a session: %s", err)
+		}
+		return 0, false
+	}
+
+	return session.cookieTimeout(now, sessionLifetime()), true
+}
+
+// end stops a session, it is rejected from now on. The backend and the token
+// of the session are returned, if any.
+func (s *sessionStore) end(id string) (string, string) {
+	session, ok := s.load(id)
+	if !ok {
+		return "", ""
+	}
+
+	if _, err := s.kapi.Delete(context.Background(), sessionEtcdKey(id), nil); err != nil && !etcd.IsKeyNotFound(err) {
+		logging.GetLogger().Errorf("Unable to end session: %s", err)
+	}
+
+	return session.Backend, session.token
+}
+
+// sessionLifetime returns the maximum lifetime of the sessions, 0 meaning
+// no limit
+func sessionLifetime() time.Duration {
+	return time.Duration(config.GetInt("http.auth.session_lifetime")) * time.Second
+}
+
+// sessionTimeout returns the shortest session timeout among the ones defined
+// for the roles of the user, 0 meaning no timeout
+func sessionTimeout(username string) time.Duration {
+	var timeout int
+	for _, role := range rbac.GetUserRoles(username) {
+		if t := config.GetInt("auth.rbac.session_timeout." + role); t > 0 && (timeout == 0 || t < timeout) {
+			timeout = t
+		}
+	}
+	return time.Duration(timeout) * time.Second
+}
+
+// sessionCookie returns the authentication cookie with a Max-Age matching the
+// session timeout
+func sessionCookie(token string, timeout time.Duration) *http.Cookie {
+	cookie := AuthCookie(token, "/")
+	cookie.MaxAge = int(timeout.Seconds())
+	return cookie
+}
+
+// backendSessionInfo returns the metadata of a session opened with a backend
+func backendSessionInfo(backend AuthenticationBackend) *SessionInfo {
+	info := &SessionInfo{Backend: backend.Name()}
+	if provider, ok := backend.(realmProvider); ok {
+		info.Realm = provider.Realm()
+	}
+	return info
+}
+
+// GetSessionInfo returns the backend and the realm of the session of a
+// request, passed by cookie or as bearer token, nil if the request has no
+// active session
+func GetSessionInfo(r *http.Request) *SessionInfo {
+	var ids []string
+	if cookie, err := r.Cookie(tokenName); err == nil && cookieAuthEnabled() {
+		ids = append(ids, cookie.Value)
+	}
+	if bearer, ok := bearerToken(requestAuthorization(r)); ok {
+		ids = append(ids, bearer)
+	}
+
+	for _, id := range ids {
+		if session, ok := sessions.get(id); ok {
+			info := session.SessionInfo
+			return &info
+		}
+	}
+	return nil
+}
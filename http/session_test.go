@@ -0,0 +1,296 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"context"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	auth "github.com/abbot/go-http-auth"
+	etcd "github.com/coreos/etcd/client"
+
+	"github.com/skydive-project/skydive/config"
+)
+
+// memoryKeysAPI is an etcd keeping the keys in memory, the TTLs being ignored
+type memoryKeysAPI struct {
+	etcd.KeysAPI
+	sync.Mutex
+	keys map[string]string
+}
+
+func (k *memoryKeysAPI) Get(ctx context.Context, key string, opts *etcd.GetOptions) (*etcd.Response, error) {
+	k.Lock()
+	defer k.Unlock()
+
+	value, ok := k.keys[key]
+	if !ok {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+	return &etcd.Response{Node: &etcd.Node{Key: key, Value: value}}, nil
+}
+
+func (k *memoryKeysAPI) Set(ctx context.Context, key, value string, opts *etcd.SetOptions) (*etcd.Response, error) {
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[key]; !ok && opts != nil && opts.PrevExist == etcd.PrevExist {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+	k.keys[key] = value
+	return &etcd.Response{Node: &etcd.Node{Key: key, Value: value}}, nil
+}
+
+func (k *memoryKeysAPI) Delete(ctx context.Context, key string, opts *etcd.DeleteOptions) (*etcd.Response, error) {
+	k.Lock()
+	defer k.Unlock()
+
+	if _, ok := k.keys[key]; !ok {
+		return nil, etcd.Error{Code: etcd.ErrorCodeKeyNotFound}
+	}
+	delete(k.keys, key)
+	return &etcd.Response{}, nil
+}
+
+func (k *memoryKeysAPI) count() int {
+	k.Lock()
+	defer k.Unlock()
+	return len(k.keys)
+}
+
+// useMemorySessions keeps the sessions in memory until the returned function
+// is called
+func useMemorySessions() func() {
+	previous := sessions
+	InitSessions(&memoryKeysAPI{keys: make(map[string]string)})
+	return func() { sessions = previous }
+}
+
+func TestSessionIdleTimeout(t *testing.T) {
+	defer useMemorySessions()()
+
+	id, _, _ := sessions.start(&SessionInfo{Backend: "basic"}, "token", 50*time.Millisecond)
+	time.Sleep(10 * time.Millisecond)
+	if _, ok := sessions.touch(id, 50*time.Millisecond); !ok {
+		t.Fatal("Session should still be active")
+	}
+	if session, ok := sessions.lookup("basic", id); !ok || session.token != "token" {
+		t.Fatal("Session should hold the token issued by the backend")
+	}
+	if _, ok := sessions.lookup("keystone", id); ok {
+		t.Fatal("Session shouldn't be used with another backend")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := sessions.lookup("basic", id); ok {
+		t.Fatal("Session should have expired")
+	}
+	if _, ok := sessions.touch(id, 50*time.Millisecond); ok {
+		t.Fatal("Expired session shouldn't be accepted again")
+	}
+
+	// a new login starts a new session
+	renewed, _, _ := sessions.start(&SessionInfo{Backend: "basic"}, "token", 50*time.Millisecond)
+	if renewed == id {
+		t.Fatal("A new session should get a new identifier")
+	}
+	if _, ok := sessions.lookup("basic", renewed); !ok {
+		t.Fatal("Session should be active after a new login")
+	}
+	if _, ok := sessions.lookup("basic", id); ok {
+		t.Fatal("Expired session shouldn't be accepted after a new login")
+	}
+
+	// no timeout, no idle expiration
+	other, timeout, _ := sessions.start(&SessionInfo{Backend: "basic"}, "other", 0)
+	if _, ok := sessions.lookup("basic", other); !ok || timeout != 0 {
+		t.Fatal("Session without timeout should never expire")
+	}
+
+	// unknown or ended sessions are rejected
+	if _, ok := sessions.lookup("basic", "token"); ok {
+		t.Fatal("Backend token shouldn't be accepted as session")
+	}
+	if backend, token := sessions.end(other); backend != "basic" || token != "other" {
+		t.Fatalf("Ending a session should return its backend and token, got %s and %s", backend, token)
+	}
+	if _, ok := sessions.lookup("basic", other); ok {
+		t.Fatal("Ended session shouldn't be accepted")
+	}
+	if _, ok := sessions.touch(other, 0); ok {
+		t.Fatal("Ended session shouldn't be recorded again")
+	}
+}
+
+func TestSessionStorage(t *testing.T) {
+	defer useMemorySessions()()
+
+	id, _, err := sessions.start(&SessionInfo{Backend: "basic"}, "secret-token", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// neither the identifier nor the token can be read from the store
+	for key, value := range sessions.kapi.(*memoryKeysAPI).keys {
+		if strings.Contains(key, id) || strings.Contains(value, id) || strings.Contains(value, "secret-token") {
+			t.Errorf("The session identifier and token should not be stored in clear: %s %s", key, value)
+		}
+	}
+}
+
+func TestCookieBackendToken(t *testing.T) {
+	defer useMemorySessions()()
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var called bool
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) { called = true })
+
+	// the clients authenticating with a token set it as cookie
+	r := &http.Request{Header: make(http.Header)}
+	SetAuthHeaders(&r.Header, &AuthenticationOpts{Token: base64.StdEncoding.EncodeToString([]byte("user1:pass1"))})
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	handler(w, r)
+
+	if !called || w.status == http.StatusUnauthorized {
+		t.Error("The token of the backend should be accepted as cookie")
+	}
+}
+
+func TestSessionLifetime(t *testing.T) {
+	config.Set("http.auth.session_lifetime", 1)
+	defer config.Set("http.auth.session_lifetime", 0)
+	defer useMemorySessions()()
+
+	id, timeout, _ := sessions.start(&SessionInfo{Backend: "basic"}, "token", time.Hour)
+	if timeout > time.Second {
+		t.Fatalf("Cookie timeout should be clamped to the session lifetime, got %s", timeout)
+	}
+	if _, timeout, _ := sessions.start(&SessionInfo{Backend: "basic"}, "token", 0); timeout <= 0 || timeout > time.Second {
+		t.Fatalf("Cookie timeout should be the session lifetime without idle timeout, got %s", timeout)
+	}
+
+	// recording the use of the session doesn't extend its lifetime
+	time.Sleep(600 * time.Millisecond)
+	if timeout, ok := sessions.touch(id, time.Minute); !ok || timeout > 400*time.Millisecond {
+		t.Fatalf("Session should still be active until the end of its lifetime, got %s", timeout)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if _, ok := sessions.lookup("basic", id); ok {
+		t.Fatal("Session should have expired")
+	}
+	if _, ok := sessions.touch(id, time.Hour); ok {
+		t.Fatal("Session past its lifetime shouldn't be accepted again")
+	}
+}
+
+func TestSessionLifetimeEnforced(t *testing.T) {
+	config.Set("http.auth.session_lifetime", 1)
+	defer config.Set("http.auth.session_lifetime", 0)
+	defer useMemorySessions()()
+
+	provider := NewHtpasswdMapProvider(map[string]string{"user1": "pass1"})
+	basic, err := NewBasicAuthenticationBackend("basic", provider.SecretProvider(), defaultUserRole)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	form := url.Values{"username": {"user1"}, "password": {"pass1"}}
+	r, _ := http.NewRequest("POST", "/login", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := &fakeResponseWriter{headers: make(http.Header)}
+	(&Server{}).serveLogin(w, r, basic)
+
+	if w.status != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.status)
+	}
+	cookies := w.Header()["Set-Cookie"]
+
+	var called bool
+	handler := basic.Wrap(func(w http.ResponseWriter, r *auth.AuthenticatedRequest) { called = true })
+
+	use := func() bool {
+		called = false
+		w := &fakeResponseWriter{headers: make(http.Header)}
+		handler(w, &http.Request{Header: http.Header{"Cookie": cookies}})
+		return called && w.status != http.StatusUnauthorized
+	}
+
+	if !use() {
+		t.Fatal("The session cookie should be accepted during the session lifetime")
+	}
+
+	// the token keeps being rejected once the lifetime is over
+	time.Sleep(1200 * time.Millisecond)
+	for i := 0; i < 3; i++ {
+		if use() {
+			t.Fatalf("The session cookie shouldn't be accepted past the session lifetime (attempt %d)", i+1)
+		}
+	}
+}
+
+func TestSessionInfo(t *testing.T) {
+	defer useMemorySessions()()
+
+	info := &SessionInfo{Backend: "keystone", Realm: "Default"}
+	id, _, err := sessions.start(info, "token1", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := &http.Request{Header: make(http.Header)}
+	r.AddCookie(AuthCookie(id, "/"))
+	if got := GetSessionInfo(r); got == nil || *got != *info {
+		t.Fatalf("Expected session info %+v, got %+v", info, got)
+	}
+
+	r = &http.Request{Header: make(http.Header)}
+	r.Header.Set("Authorization", "Bearer "+id)
+	if got := GetSessionInfo(r); got == nil || *got != *info {
+		t.Fatalf("Expected session info %+v for the bearer token, got %+v", info, got)
+	}
+
+	// a token of the backend has no session
+	r = &http.Request{Header: make(http.Header)}
+	r.AddCookie(AuthCookie("token1", "/"))
+	if got := GetSessionInfo(r); got != nil {
+		t.Errorf("A token of the backend shouldn't have session info, got %+v", got)
+	}
+
+	sessions.end(id)
+	r = &http.Request{Header: make(http.Header)}
+	r.AddCookie(AuthCookie(id, "/"))
+	if got := GetSessionInfo(r); got != nil {
+		t.Errorf("An ended session shouldn't have session info, got %+v", got)
+	}
+}
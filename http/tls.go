@@ -23,8 +23,14 @@
 package http
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
 	"net/http"
+	"strings"
 
 	"github.com/skydive-project/skydive/common"
 	"github.com/skydive-project/skydive/config"
@@ -65,3 +71,29 @@ func checkTLSConfig(tlsConfig *tls.Config) {
 		logging.GetLogger().Warning("======> You running the agent in Insecure, the certificate can't be verified, generally use for test purpose, Please make sure it what's you want <======\n PRODUCTION must not run in Insecure\n")
 	}
 }
+
+// newPinnedTLSConfig returns a TLS configuration only accepting peers whose
+// certificate SHA-256 fingerprint matches one of the pins, on top of the
+// regular chain verification. Several pins can be given to allow rotation.
+func newPinnedTLSConfig(pins []string) (*tls.Config, error) {
+	fingerprints := make(map[string]bool)
+	for _, pin := range pins {
+		fingerprint := strings.ToLower(strings.Replace(pin, ":", "", -1))
+		if b, err := hex.DecodeString(fingerprint); err != nil || len(b) != sha256.Size {
+			return nil, fmt.Errorf("Invalid TLS pin, SHA-256 fingerprint expected: %s", pin)
+		}
+		fingerprints[fingerprint] = true
+	}
+
+	return &tls.Config{
+		VerifyPeerCertificate: func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+			if len(rawCerts) > 0 {
+				sum := sha256.Sum256(rawCerts[0])
+				if fingerprints[hex.EncodeToString(sum[:])] {
+					return nil
+				}
+			}
+			return errors.New("Peer certificate doesn't match any of the pinned fingerprints")
+		},
+	}, nil
+}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package http
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPinnedTLSConfig(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	sum := sha256.Sum256(server.Certificate().Raw)
+	pin := hex.EncodeToString(sum[:])
+
+	get := func(pins []string) error {
+		tlsConfig, err := newPinnedTLSConfig(pins)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tlsConfig.RootCAs = roots
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		resp, err := client.Get(server.URL)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+
+	// colon separated, upper case fingerprint among other pins
+	colons := strings.ToUpper(pin[0:2])
+	for i := 2; i < len(pin); i += 2 {
+		colons += ":" + strings.ToUpper(pin[i:i+2])
+	}
+	if err := get([]string{strings.Repeat("0", 64), colons}); err != nil {
+		t.Errorf("Connection with a matching pin should succeed: %s", err)
+	}
+
+	if err := get([]string{strings.Repeat("0", 64)}); err == nil {
+		t.Error("Connection without a matching pin should fail")
+	}
+
+	if _, err := newPinnedTLSConfig([]string{"abcd"}); err == nil {
+		t.Error("Pin with an invalid fingerprint should be rejected")
+	}
+}
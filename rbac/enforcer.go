@@ -28,13 +28,18 @@ import (
 	"io"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/casbin/casbin"
 	"github.com/casbin/casbin/model"
 	"github.com/casbin/casbin/persist"
+	casbinrbac "github.com/casbin/casbin/rbac"
+	defaultrolemanager "github.com/casbin/casbin/rbac/default-role-manager"
 	etcd "github.com/coreos/etcd/client"
 
 	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/logging"
 	"github.com/skydive-project/skydive/statics"
 )
 
@@ -45,7 +50,78 @@ type Permission struct {
 	Allowed bool
 }
 
-var enforcer *casbin.Enforcer
+// RoleTransformer adjusts the roles of a user before its permissions are
+// resolved. It is called on every access decision so it has to be fast and
+// free of side effects.
+type RoleTransformer func(user string, roles []string) []string
+
+// Authorizer takes the access decisions in place of the policy, for instance
+// to delegate them to an external system. It is given the user along with
+// its roles.
+type Authorizer interface {
+	Authorize(user string, roles []string, obj, act string) (bool, error)
+}
+
+// PermissionLister can be implemented by an authorizer to resolve the
+// permissions of a user at once rather than one decision at a time
+type PermissionLister interface {
+	Permissions(user string, roles []string, candidates []Permission) ([]Permission, error)
+}
+
+// scope restricts a subject acting on behalf of a user to some of the roles
+// of the user
+type scope struct {
+	user   string
+	roles  []string
+	expiry time.Time
+}
+
+var (
+	enforcer   *casbin.Enforcer
+	authorizer Authorizer
+
+	transformerLock sync.RWMutex
+	roleTransformer RoleTransformer
+
+	scopesLock sync.RWMutex
+	scopes     = make(map[string]*scope)
+)
+
+// roleManager resolves the roles of the subjects matched by the policy
+// matchers, the roles of a user being the transformed roles and the roles
+// of a scoped subject the roles of its scope. The inheritance between the
+// roles is resolved by the wrapped role manager.
+type roleManager struct {
+	casbinrbac.RoleManager
+}
+
+func (rm *roleManager) HasLink(name1 string, name2 string, domain ...string) bool {
+	if len(domain) != 0 || name1 == name2 {
+		return rm.RoleManager.HasLink(name1, name2, domain...)
+	}
+
+	var roles []string
+	if scope, ok := subjectScope(name1); ok {
+		roles = scope.roles
+	} else if transformer := getRoleTransformer(); transformer != nil {
+		roles = transformer(name1, rm.RoleManager.GetRoles(name1))
+	} else {
+		return rm.RoleManager.HasLink(name1, name2)
+	}
+
+	for _, role := range roles {
+		if rm.RoleManager.HasLink(role, name2) {
+			return true
+		}
+	}
+	return false
+}
+
+func newEnforcer() *casbin.Enforcer {
+	e := casbin.NewEnforcer()
+	e.SetRoleManager(&roleManager{RoleManager: defaultrolemanager.NewRoleManager(10)})
+	return e
+}
 
 func loadSection(model model.Model, key string, sec string) {
 	getKey := func(i int) string {
@@ -110,7 +186,7 @@ func Init(kapi etcd.KeysAPI) error {
 		return err
 	}
 
-	casbinEnforcer := casbin.NewEnforcer()
+	casbinEnforcer := newEnforcer()
 	casbinEnforcer.InitWithModelAndAdapter(model, etcdAdapter)
 
 	if err := loadStaticPolicy(model); err != nil {
@@ -134,15 +210,139 @@ func Init(kapi etcd.KeysAPI) error {
 	return nil
 }
 
+// SetRoleTransformer registers a transformer applied system-wide to the roles
+// of the users, a nil transformer disables the transformation
+func SetRoleTransformer(transformer RoleTransformer) {
+	transformerLock.Lock()
+	roleTransformer = transformer
+	transformerLock.Unlock()
+}
+
+func getRoleTransformer() RoleTransformer {
+	transformerLock.RLock()
+	defer transformerLock.RUnlock()
+	return roleTransformer
+}
+
+// SetAuthorizer registers an authorizer taking the access decisions in place
+// of the policy, a nil authorizer restoring the policy
+func SetAuthorizer(a Authorizer) {
+	authorizer = a
+}
+
+// SetSubjectScope registers a subject acting on behalf of a user. The access
+// decisions of the subject are the ones of the user, user-level denies
+// included, further restricted to the given roles. The scope is dropped
+// after the expiry, a zero expiry meaning none.
+func SetSubjectScope(subject, user string, roles []string, expiry time.Time) {
+	scopesLock.Lock()
+	defer scopesLock.Unlock()
+
+	now := time.Now()
+	for s, scope := range scopes {
+		if !scope.expiry.IsZero() && now.After(scope.expiry) {
+			delete(scopes, s)
+		}
+	}
+
+	scopes[subject] = &scope{user: user, roles: append([]string{}, roles...), expiry: expiry}
+}
+
+// RemoveSubjectScope removes the scope of a subject
+func RemoveSubjectScope(subject string) {
+	scopesLock.Lock()
+	defer scopesLock.Unlock()
+
+	delete(scopes, subject)
+}
+
+// subjectScope returns the scope of a subject, if any and not expired
+func subjectScope(subject string) (*scope, bool) {
+	scopesLock.RLock()
+	defer scopesLock.RUnlock()
+
+	scope, ok := scopes[subject]
+	if !ok || (!scope.expiry.IsZero() && time.Now().After(scope.expiry)) {
+		return nil, false
+	}
+	return scope, true
+}
+
+// effectiveRoles returns the roles of a user once transformed
+func effectiveRoles(user string) []string {
+	roles := enforcer.GetRolesForUser(user)
+	if transformer := getRoleTransformer(); transformer != nil {
+		roles = transformer(user, append([]string{}, roles...))
+	}
+	return roles
+}
+
+// inheritedRoles returns the roles along with the roles they inherit from
+func inheritedRoles(roles []string) []string {
+	seen := make(map[string]bool)
+	var all []string
+	for len(roles) > 0 {
+		role := roles[0]
+		roles = roles[1:]
+		if !seen[role] {
+			seen[role] = true
+			all = append(all, role)
+			roles = append(roles, enforcer.GetRolesForUser(role)...)
+		}
+	}
+	return all
+}
+
 // Enforce decides whether a "subject" can access an "object" with the operation "action"
 func Enforce(sub, obj, act string) bool {
 	if enforcer == nil {
 		return true
 	}
 
+	// the roles of the scope are resolved by the role manager
+	if scope, ok := subjectScope(sub); ok {
+		return Enforce(scope.user, obj, act) && enforcer.Enforce(sub, obj, act)
+	}
+
+	if authorizer != nil {
+		allowed, err := authorizer.Authorize(sub, effectiveRoles(sub), obj, act)
+		if err != nil {
+			logging.GetLogger().Errorf("Unable to authorize %s to %s %s: %s", sub, act, obj, err)
+			return false
+		}
+		return allowed
+	}
+
 	return enforcer.Enforce(sub, obj, act)
 }
 
+// EnforceAll decides like Enforce whether a subject can access an object
+// with every action, the first action denied being returned. When
+// unrestricted, the actions for which no permission of the subject is defined
+// are granted, so that the roles defined before these actions keep their
+// access, the permissions of the subject being looked up once.
+func EnforceAll(sub, obj string, unrestricted bool, acts ...string) (string, bool) {
+	var defined map[string]bool
+	if unrestricted {
+		defined = make(map[string]bool)
+		for _, permission := range GetPermissionsForUser(sub) {
+			if permission.Object == obj {
+				defined[permission.Action] = true
+			}
+		}
+	}
+
+	for _, act := range acts {
+		if unrestricted && !defined[act] {
+			continue
+		}
+		if !Enforce(sub, obj, act) {
+			return act, false
+		}
+	}
+	return "", true
+}
+
 func AddRoleForUser(user, role string) bool {
 	if enforcer == nil {
 		return false
@@ -151,11 +351,76 @@ func AddRoleForUser(user, role string) bool {
 	return enforcer.AddRoleForUser(user, role)
 }
 
+// SetRolesForUser replaces the roles of a user, the roles being left
+// untouched if they already match
+func SetRolesForUser(user string, roles []string) {
+	if enforcer == nil {
+		return
+	}
+
+	current := enforcer.GetRolesForUser(user)
+	if len(current) == len(roles) {
+		same := true
+		for _, role := range roles {
+			if !enforcer.HasRoleForUser(user, role) {
+				same = false
+				break
+			}
+		}
+		if same {
+			return
+		}
+	}
+
+	enforcer.DeleteRolesForUser(user)
+	for _, role := range roles {
+		enforcer.AddRoleForUser(user, role)
+	}
+}
+
+// RoleExists returns whether permissions are defined for a role, either
+// directly or through the roles it inherits from. Without enforcer every
+// role is accepted, as well as with an authorizer which defines the
+// permissions of the roles outside of the policy.
+func RoleExists(role string) bool {
+	if enforcer == nil || authorizer != nil {
+		return true
+	}
+
+	return len(enforcer.GetPermissionsForUser(role)) != 0 || len(enforcer.GetRolesForUser(role)) != 0
+}
+
+// IsProtectedRole returns whether a role can only be granted explicitly by an
+// administrator
+func IsProtectedRole(role string) bool {
+	for _, protected := range config.GetStringSlice("rbac.protected_roles") {
+		if role == protected {
+			return true
+		}
+	}
+	return false
+}
+
+// ProvisionRoleForUser adds a role to a user as part of an automatic
+// provisioning. Protected roles are never granted this way.
+func ProvisionRoleForUser(user, role string) bool {
+	if IsProtectedRole(role) {
+		logging.GetLogger().Warningf("Refusing to automatically grant protected role %s to user %s", role, user)
+		return false
+	}
+
+	return AddRoleForUser(user, role)
+}
+
 func GetUserRoles(user string) []string {
 	if enforcer == nil {
 		return []string{}
 	}
 
+	if scope, ok := subjectScope(user); ok {
+		return append([]string{}, scope.roles...)
+	}
+
 	return enforcer.GetRolesForUser(user)
 }
 
@@ -165,16 +430,55 @@ func GetPermissionsForUser(user string) []Permission {
 		return nil
 	}
 
-	subjects := enforcer.GetRolesForUser(user)
+	if scope, ok := subjectScope(user); ok {
+		permissions := GetPermissionsForUser(scope.user)
+		for i, permission := range permissions {
+			if permission.Allowed && !enforcer.Enforce(user, permission.Object, permission.Action) {
+				permissions[i].Allowed = false
+			}
+		}
+		return permissions
+	}
+
+	// report the decisions of the authorizer for the objects and actions
+	// known by the policy
+	if authorizer != nil {
+		var permissions []Permission
+		seen := make(map[string]bool)
+		for _, p := range enforcer.GetPolicy() {
+			if key := p[1] + p[2]; !seen[key] {
+				seen[key] = true
+				permissions = append(permissions, Permission{Object: p[1], Action: p[2]})
+			}
+		}
+
+		if lister, ok := authorizer.(PermissionLister); ok {
+			resolved, err := lister.Permissions(user, effectiveRoles(user), permissions)
+			if err != nil {
+				logging.GetLogger().Errorf("Unable to list the permissions of %s: %s", user, err)
+				return permissions
+			}
+			return resolved
+		}
+
+		for i, permission := range permissions {
+			permissions[i].Allowed = Enforce(user, permission.Object, permission.Action)
+		}
+		return permissions
+	}
+
+	subjects := inheritedRoles(effectiveRoles(user))
 	subjects = append(subjects, user)
 
+	// the permissions defined for the user, the decisions being the ones
+	// of the policy effect
 	mperms := make(map[string]Permission)
 	for _, subject := range subjects {
 		for _, p := range enforcer.GetPermissionsForUser(subject) {
-			permission := Permission{Object: p[1], Action: p[2], Allowed: p[3] == "allow"}
-
-			key := permission.Object + permission.Action
-			mperms[key] = permission
+			key := p[1] + p[2]
+			if _, ok := mperms[key]; !ok {
+				mperms[key] = Permission{Object: p[1], Action: p[2], Allowed: enforcer.Enforce(user, p[1], p[2])}
+			}
 		}
 	}
 
@@ -185,3 +489,27 @@ func GetPermissionsForUser(user string) []Permission {
 
 	return permissions
 }
+
+// Access levels summarizing the permissions of a user
+const (
+	AccessLevelNone  = "none"
+	AccessLevelRead  = "read"
+	AccessLevelWrite = "write"
+)
+
+// GetAccessLevelForUser returns a coarse access level of a user: "write" if
+// any action other than read is allowed, "read" if only read actions are
+// allowed, "none" otherwise
+func GetAccessLevelForUser(user string) string {
+	level := AccessLevelNone
+	for _, permission := range GetPermissionsForUser(user) {
+		if !permission.Allowed {
+			continue
+		}
+		if permission.Action != "read" {
+			return AccessLevelWrite
+		}
+		level = AccessLevelRead
+	}
+	return level
+}
@@ -0,0 +1,308 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package rbac
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/casbin/casbin/model"
+
+	"github.com/skydive-project/skydive/config"
+)
+
+// initTestEnforcer sets up an enforcer with the model of the configuration
+// and the given policy lines, returns a function restoring the previous one
+func initTestEnforcer(t *testing.T, policy ...string) func() {
+	m := model.Model{}
+	loadSection(m, "request_definition", "r")
+	loadSection(m, "policy_definition", "p")
+	loadSection(m, "policy_effect", "e")
+	loadSection(m, "matchers", "m")
+	loadSection(m, "role_definition", "g")
+
+	e := newEnforcer()
+	e.InitWithModelAndAdapter(m, nil)
+	if err := loadPolicy([]byte(strings.Join(policy, "\n")), m); err != nil {
+		t.Fatal(err)
+	}
+	e.BuildRoleLinks()
+
+	previous := enforcer
+	enforcer = e
+	return func() { enforcer = previous }
+}
+
+func TestSubjectScope(t *testing.T) {
+	defer initTestEnforcer(t,
+		"p, admin, capture, read, allow",
+		"p, admin, capture, write, allow",
+		"p, admin, topology, read, allow",
+		"p, guest, topology, read, allow",
+		"p, guest, capture, read, allow",
+		"p, user1, capture, read, deny",
+		"g, user1, admin",
+		"g, user1, guest",
+	)()
+
+	subject := "user1/pat:0123"
+	SetSubjectScope(subject, "user1", []string{"guest"}, time.Time{})
+	defer RemoveSubjectScope(subject)
+
+	// restricted to the roles of the scope
+	if !Enforce(subject, "topology", "read") {
+		t.Error("The scoped subject should be allowed to read the topology")
+	}
+	if Enforce(subject, "capture", "write") {
+		t.Error("The scoped subject shouldn't get the admin permissions of the user")
+	}
+
+	// the denies of the user apply to the scoped subject
+	if Enforce(subject, "capture", "read") {
+		t.Error("A deny of the user should deny the scoped subject")
+	}
+
+	if roles := GetUserRoles(subject); len(roles) != 1 || roles[0] != "guest" {
+		t.Errorf("Expected the roles of the scope, got %v", roles)
+	}
+	for _, permission := range GetPermissionsForUser(subject) {
+		if permission.Object == "capture" && permission.Allowed {
+			t.Errorf("The scoped subject shouldn't be allowed to %s captures", permission.Action)
+		}
+	}
+
+	// the subject gets no permission once the scope expired
+	SetSubjectScope(subject, "user1", []string{"guest"}, time.Now().Add(-time.Second))
+	if Enforce(subject, "topology", "read") {
+		t.Error("An expired scope shouldn't grant any permission")
+	}
+}
+
+func TestEnforceAll(t *testing.T) {
+	defer initTestEnforcer(t,
+		"p, admin, capture, write, allow",
+		"p, admin, capture, afpacket, allow",
+		"p, guest, capture, afpacket, deny",
+		"p, operator, capture, write, allow",
+		"p, user3, capture, afpacket, deny",
+		"g, user1, admin",
+		"g, user2, operator",
+		"g, user3, operator",
+		"g, user4, guest",
+	)()
+
+	for _, test := range []struct {
+		user         string
+		allowed      bool
+		unrestricted bool
+	}{
+		{"user1", true, true},   // allowed by its role
+		{"user2", false, true},  // role only granted the capture write permission
+		{"user3", false, false}, // user-level deny
+		{"user4", false, false}, // denied by its role
+	} {
+		if _, allowed := EnforceAll(test.user, "capture", false, "write", "afpacket"); allowed != test.allowed {
+			t.Errorf("Expected %s allowed %v to use afpacket, got %v", test.user, test.allowed, allowed)
+		}
+		if _, allowed := EnforceAll(test.user, "capture", true, "afpacket"); allowed != test.unrestricted {
+			t.Errorf("Expected %s allowed %v to use afpacket when unrestricted, got %v", test.user, test.unrestricted, allowed)
+		}
+	}
+
+	if act, _ := EnforceAll("user2", "capture", false, "write", "afpacket", "pcap"); act != "afpacket" {
+		t.Errorf("The first denied action should be returned, got %s", act)
+	}
+}
+
+func TestRoleExists(t *testing.T) {
+	defer initTestEnforcer(t,
+		"p, admin, capture, write, allow",
+		"g, operator, admin",
+	)()
+
+	for _, test := range []struct {
+		role   string
+		exists bool
+	}{
+		{"admin", true},
+		{"operator", true}, // inherits its permissions
+		{"unknown", false},
+	} {
+		if exists := RoleExists(test.role); exists != test.exists {
+			t.Errorf("Expected role %s to exist %v, got %v", test.role, test.exists, exists)
+		}
+	}
+}
+
+func TestProvisionProtectedRole(t *testing.T) {
+	defer initTestEnforcer(t,
+		"p, superadmin, capture, write, allow",
+		"p, guest, capture, read, allow",
+	)()
+
+	config.Set("rbac.protected_roles", []string{"superadmin"})
+	defer config.Set("rbac.protected_roles", []string{})
+
+	if ProvisionRoleForUser("user1", "superadmin") {
+		t.Error("A protected role shouldn't be provisioned")
+	}
+	if roles := GetUserRoles("user1"); len(roles) != 0 {
+		t.Errorf("Expected no role, got %v", roles)
+	}
+	if Enforce("user1", "capture", "write") {
+		t.Error("The permissions of the protected role shouldn't be granted")
+	}
+
+	if !ProvisionRoleForUser("user1", "guest") || !Enforce("user1", "capture", "read") {
+		t.Error("A role not protected should be provisioned")
+	}
+
+	// granted explicitly by an administrator
+	if !AddRoleForUser("user2", "superadmin") || !Enforce("user2", "capture", "write") {
+		t.Error("A protected role should be granted explicitly")
+	}
+}
+
+func TestRoleTransformer(t *testing.T) {
+	defer initTestEnforcer(t,
+		"p, admin, capture, write, allow",
+		"p, admin, topology, read, allow",
+		"p, guest, topology, read, allow",
+		"p, user1, capture, write, deny",
+		"g, superadmin, admin",
+		"g, user1, guest",
+		"g, user2, guest",
+	)()
+
+	// elevate the users having the guest role
+	SetRoleTransformer(func(user string, roles []string) []string {
+		for _, role := range roles {
+			if role == "guest" {
+				return append(roles, "superadmin")
+			}
+		}
+		return roles
+	})
+	defer SetRoleTransformer(nil)
+
+	// the transformed role inherits its permissions from admin
+	if !Enforce("user2", "capture", "write") {
+		t.Error("The permissions inherited by the transformed roles should be granted")
+	}
+
+	// the user-level deny still takes precedence through the policy effect
+	if Enforce("user1", "capture", "write") {
+		t.Error("A user-level deny should take precedence over the transformed roles")
+	}
+	for _, permission := range GetPermissionsForUser("user1") {
+		if permission.Object == "capture" && permission.Action == "write" && permission.Allowed {
+			t.Error("The permissions should report the deny of the user")
+		}
+	}
+
+	var found bool
+	for _, permission := range GetPermissionsForUser("user2") {
+		if permission.Object == "capture" && permission.Action == "write" {
+			found = permission.Allowed
+		}
+	}
+	if !found {
+		t.Error("The permissions should report the inherited permissions of the transformed roles")
+	}
+
+	SetRoleTransformer(nil)
+	if Enforce("user2", "capture", "write") {
+		t.Error("Without transformer the stored roles should be used")
+	}
+}
+
+func TestRoleTransformerConcurrency(t *testing.T) {
+	defer initTestEnforcer(t, "p, guest, topology, read, allow", "g, user1, guest")()
+	defer SetRoleTransformer(nil)
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			SetRoleTransformer(func(user string, roles []string) []string { return roles })
+			SetRoleTransformer(nil)
+		}
+	}()
+
+	for i := 0; i < 100; i++ {
+		if !Enforce("user1", "topology", "read") {
+			t.Fatal("The user should be allowed whatever the transformer")
+		}
+	}
+	<-done
+}
+
+// listingAuthorizer allows the read actions and counts the decisions
+type listingAuthorizer struct {
+	decisions int
+	listings  int
+}
+
+func (a *listingAuthorizer) Authorize(user string, roles []string, obj, act string) (bool, error) {
+	a.decisions++
+	return act == "read", nil
+}
+
+func (a *listingAuthorizer) Permissions(user string, roles []string, candidates []Permission) ([]Permission, error) {
+	a.listings++
+	for i := range candidates {
+		candidates[i].Allowed = candidates[i].Action == "read"
+	}
+	return candidates, nil
+}
+
+func TestPermissionLister(t *testing.T) {
+	defer initTestEnforcer(t,
+		"p, admin, capture, read, allow",
+		"p, admin, capture, write, allow",
+		"p, guest, capture, read, allow",
+	)()
+
+	a := &listingAuthorizer{}
+	SetAuthorizer(a)
+	defer SetAuthorizer(nil)
+
+	permissions := GetPermissionsForUser("user1")
+	if len(permissions) != 2 {
+		t.Fatalf("Expected 2 permissions, got %+v", permissions)
+	}
+	for _, permission := range permissions {
+		if permission.Allowed != (permission.Action == "read") {
+			t.Errorf("Wrong decision for %+v", permission)
+		}
+	}
+
+	if a.listings != 1 || a.decisions != 0 {
+		t.Errorf("Expected a single listing, got %d listings and %d decisions", a.listings, a.decisions)
+	}
+
+	if !RoleExists("unknown") {
+		t.Error("Roles aren't defined by the policy with an authorizer")
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package k8s
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	authorization "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/clientcmd"
+
+	"github.com/skydive-project/skydive/config"
+	"github.com/skydive-project/skydive/rbac"
+)
+
+const maxCachedDecisions = 1024
+
+type decision struct {
+	allowed bool
+	expiry  time.Time
+}
+
+// SubjectAccessReviewAuthorizer delegates the access decisions to the
+// Kubernetes API through SubjectAccessReviews, so that the Skydive
+// permissions are managed with the Kubernetes RBAC objects. The Skydive
+// objects are the resources of an API group and the actions their verbs, the
+// user being mapped to a Kubernetes user. The roles of the user are only
+// mapped to Kubernetes groups when a group prefix is configured, so that the
+// roles granted by Skydive never match the groups of the cluster.
+type SubjectAccessReviewAuthorizer struct {
+	sync.Mutex
+	clientset   kubernetes.Interface
+	apiGroup    string
+	userPrefix  string
+	groupPrefix string
+	ttl         time.Duration
+	decisions   map[string]decision
+}
+
+func (a *SubjectAccessReviewAuthorizer) groups(roles []string) []string {
+	if a.groupPrefix == "" {
+		return nil
+	}
+
+	groups := make([]string, len(roles))
+	for i, role := range roles {
+		groups[i] = a.groupPrefix + role
+	}
+	sort.Strings(groups)
+	return groups
+}
+
+func (a *SubjectAccessReviewAuthorizer) cached(key string) (bool, bool) {
+	a.Lock()
+	defer a.Unlock()
+
+	d, ok := a.decisions[key]
+	if !ok || time.Now().After(d.expiry) {
+		return false, false
+	}
+	return d.allowed, true
+}
+
+// cache records a decision, the expired decisions being pruned when the
+// cache is full and the ones expiring first evicted if none has expired
+func (a *SubjectAccessReviewAuthorizer) cache(key string, allowed bool) {
+	if a.ttl <= 0 {
+		return
+	}
+
+	a.Lock()
+	defer a.Unlock()
+
+	now := time.Now()
+	if _, ok := a.decisions[key]; !ok && len(a.decisions) >= maxCachedDecisions {
+		for k, d := range a.decisions {
+			if now.After(d.expiry) {
+				delete(a.decisions, k)
+			}
+		}
+
+		for len(a.decisions) >= maxCachedDecisions {
+			var oldest string
+			for k, d := range a.decisions {
+				if oldest == "" || d.expiry.Before(a.decisions[oldest].expiry) {
+					oldest = k
+				}
+			}
+			delete(a.decisions, oldest)
+		}
+	}
+	a.decisions[key] = decision{allowed: allowed, expiry: now.Add(a.ttl)}
+}
+
+func (a *SubjectAccessReviewAuthorizer) review(user string, groups []string, obj, act string) (bool, error) {
+	key := strings.Join([]string{user, strings.Join(groups, ","), obj, act}, "\x00")
+	if allowed, ok := a.cached(key); ok {
+		return allowed, nil
+	}
+
+	review := &authorization.SubjectAccessReview{
+		Spec: authorization.SubjectAccessReviewSpec{
+			User:   a.userPrefix + user,
+			Groups: groups,
+			ResourceAttributes: &authorization.ResourceAttributes{
+				Group:    a.apiGroup,
+				Resource: obj,
+				Verb:     act,
+			},
+		},
+	}
+
+	result, err := a.clientset.AuthorizationV1().SubjectAccessReviews().Create(review)
+	if err != nil {
+		return false, err
+	}
+
+	a.cache(key, result.Status.Allowed)
+
+	return result.Status.Allowed, nil
+}
+
+// Authorize issues a SubjectAccessReview for the user and its roles, the
+// decisions being cached for a short time
+func (a *SubjectAccessReviewAuthorizer) Authorize(user string, roles []string, obj, act string) (bool, error) {
+	return a.review(user, a.groups(roles), obj, act)
+}
+
+// Permissions resolves the given permissions for the user and its roles.
+// The reviews are issued concurrently and their decisions cached like the
+// ones of Authorize, so that listing the permissions of a user only queries
+// the Kubernetes API once per cache period.
+func (a *SubjectAccessReviewAuthorizer) Permissions(user string, roles []string, candidates []rbac.Permission) ([]rbac.Permission, error) {
+	groups := a.groups(roles)
+	permissions := make([]rbac.Permission, len(candidates))
+	errs := make([]error, len(candidates))
+
+	var wg sync.WaitGroup
+	for i, candidate := range candidates {
+		wg.Add(1)
+		go func(i int, candidate rbac.Permission) {
+			defer wg.Done()
+			candidate.Allowed, errs[i] = a.review(user, groups, candidate.Object, candidate.Action)
+			permissions[i] = candidate
+		}(i, candidate)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return permissions, nil
+}
+
+// NewSubjectAccessReviewAuthorizer returns an authorizer using the given
+// Kubernetes client
+func NewSubjectAccessReviewAuthorizer(clientset kubernetes.Interface, apiGroup, userPrefix, groupPrefix string, ttl time.Duration) *SubjectAccessReviewAuthorizer {
+	return &SubjectAccessReviewAuthorizer{
+		clientset:   clientset,
+		apiGroup:    apiGroup,
+		userPrefix:  userPrefix,
+		groupPrefix: groupPrefix,
+		ttl:         ttl,
+		decisions:   make(map[string]decision),
+	}
+}
+
+// NewSubjectAccessReviewAuthorizerFromConfig returns an authorizer using the
+// Kubernetes configuration file, the in-cluster configuration being used
+// when the file isn't found
+func NewSubjectAccessReviewAuthorizerFromConfig() (*SubjectAccessReviewAuthorizer, error) {
+	kubeconfig := config.GetString("k8s.config_file")
+	restConfig, err := clientcmd.BuildConfigFromFlags("", kubeconfig)
+	if err != nil {
+		loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+		kubeConfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{})
+		if restConfig, err = kubeConfig.ClientConfig(); err != nil {
+			return nil, fmt.Errorf("Failed to load Kubernetes config: %s", err)
+		}
+	}
+
+	clientset, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create Kubernetes client: %s", err)
+	}
+
+	return NewSubjectAccessReviewAuthorizer(
+		clientset,
+		config.GetString("rbac.kubernetes.api_group"),
+		config.GetString("rbac.kubernetes.user_prefix"),
+		config.GetString("rbac.kubernetes.group_prefix"),
+		time.Duration(config.GetInt("rbac.kubernetes.cache_ttl"))*time.Second,
+	), nil
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2018 Red Hat, Inc.
+ *
+ * Licensed to the Apache Software Foundation (ASF) under one
+ * or more contributor license agreements.  See the NOTICE file
+ * distributed with this work for additional information
+ * regarding copyright ownership.  The ASF licenses this file
+ * to you under the Apache License, Version 2.0 (the
+ * "License"); you may not use this file except in compliance
+ * with the License.  You may obtain a copy of the License at
+ *
+ *  http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing,
+ * software distributed under the License is distributed on an
+ * "AS IS" BASIS, WITHOUT WARRANTIES OR CONDITIONS OF ANY
+ * KIND, either express or implied.  See the License for the
+ * specific language governing permissions and limitations
+ * under the License.
+ *
+ */
+
+package k8s
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	authorization "k8s.io/api/authorization/v1"
+	"k8s.io/client-go/kubernetes"
+	authorizationv1 "k8s.io/client-go/kubernetes/typed/authorization/v1"
+
+	"github.com/skydive-project/skydive/rbac"
+)
+
+// fakeClientset answers the SubjectAccessReviews, allowing the read verb only
+type fakeClientset struct {
+	kubernetes.Interface
+	authorizationv1.AuthorizationV1Interface
+	sync.Mutex
+	reviews []authorization.SubjectAccessReviewSpec
+}
+
+func (c *fakeClientset) AuthorizationV1() authorizationv1.AuthorizationV1Interface {
+	return c
+}
+
+func (c *fakeClientset) SubjectAccessReviews() authorizationv1.SubjectAccessReviewInterface {
+	return &fakeReviews{clientset: c}
+}
+
+func (c *fakeClientset) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.reviews)
+}
+
+type fakeReviews struct {
+	authorizationv1.SubjectAccessReviewInterface
+	clientset *fakeClientset
+}
+
+func (r *fakeReviews) Create(review *authorization.SubjectAccessReview) (*authorization.SubjectAccessReview, error) {
+	r.clientset.Lock()
+	r.clientset.reviews = append(r.clientset.reviews, review.Spec)
+	r.clientset.Unlock()
+
+	result := *review
+	result.Status.Allowed = review.Spec.ResourceAttributes.Verb == "read"
+	return &result, nil
+}
+
+func TestAuthorizeCache(t *testing.T) {
+	clientset := &fakeClientset{}
+	a := NewSubjectAccessReviewAuthorizer(clientset, "skydive.network", "", "", time.Minute)
+
+	for i := 0; i < 3; i++ {
+		if allowed, err := a.Authorize("alice", []string{"admin"}, "capture", "read"); err != nil || !allowed {
+			t.Fatalf("read should be allowed: %v %s", allowed, err)
+		}
+		if allowed, err := a.Authorize("alice", []string{"admin"}, "capture", "write"); err != nil || allowed {
+			t.Fatalf("write should be denied: %v %s", allowed, err)
+		}
+	}
+
+	if n := clientset.count(); n != 2 {
+		t.Errorf("expected 2 reviews, got %d", n)
+	}
+
+	a = NewSubjectAccessReviewAuthorizer(clientset, "skydive.network", "", "", 0)
+	a.Authorize("alice", nil, "capture", "read")
+	a.Authorize("alice", nil, "capture", "read")
+	if n := clientset.count(); n != 4 {
+		t.Errorf("decisions shouldn't be cached without ttl, got %d reviews", n)
+	}
+}
+
+func TestAuthorizeCacheLimit(t *testing.T) {
+	a := NewSubjectAccessReviewAuthorizer(&fakeClientset{}, "skydive.network", "", "", time.Minute)
+
+	for i := 0; i < 2*maxCachedDecisions; i++ {
+		if _, err := a.Authorize(fmt.Sprintf("user%d", i), nil, "capture", "read"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := len(a.decisions); n > maxCachedDecisions {
+		t.Errorf("cache exceeds its limit: %d decisions", n)
+	}
+
+	if _, ok := a.cached("user0\x00\x00capture\x00read"); ok {
+		t.Error("the oldest decision should have been evicted")
+	}
+}
+
+func TestAuthorizeGroups(t *testing.T) {
+	clientset := &fakeClientset{}
+
+	a := NewSubjectAccessReviewAuthorizer(clientset, "skydive.network", "skydive-", "", time.Minute)
+	a.Authorize("alice", []string{"admin"}, "capture", "read")
+
+	a = NewSubjectAccessReviewAuthorizer(clientset, "skydive.network", "", "skydive:", time.Minute)
+	a.Authorize("alice", []string{"admin", "guest"}, "capture", "read")
+
+	if spec := clientset.reviews[0]; spec.User != "skydive-alice" || len(spec.Groups) != 0 {
+		t.Errorf("roles shouldn't be sent as groups without prefix: %+v", spec)
+	}
+
+	if spec := clientset.reviews[1]; len(spec.Groups) != 2 || spec.Groups[0] != "skydive:admin" || spec.Groups[1] != "skydive:guest" {
+		t.Errorf("roles should be sent as prefixed groups: %+v", spec)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	clientset := &fakeClientset{}
+	a := NewSubjectAccessReviewAuthorizer(clientset, "skydive.network", "", "", time.Minute)
+
+	candidates := []rbac.Permission{
+		{Object: "capture", Action: "read"},
+		{Object: "capture", Action: "write"},
+		{Object: "topology", Action: "read"},
+	}
+
+	for i := 0; i < 3; i++ {
+		permissions, err := a.Permissions("alice", nil, candidates)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for j, permission := range permissions {
+			if permission.Object != candidates[j].Object || permission.Action != candidates[j].Action {
+				t.Fatalf("unexpected permission %+v", permission)
+			}
+			if permission.Allowed != (permission.Action == "read") {
+				t.Errorf("wrong decision for %+v", permission)
+			}
+		}
+	}
+
+	if n := clientset.count(); n != len(candidates) {
+		t.Errorf("expected %d reviews, got %d", len(candidates), n)
+	}
+
+	// the decisions of the listing are reused by Authorize
+	a.Authorize("alice", nil, "topology", "read")
+	if n := clientset.count(); n != len(candidates) {
+		t.Errorf("the listed decisions should be cached, got %d reviews", n)
+	}
+}
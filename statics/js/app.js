@@ -49,6 +49,10 @@ var store = new Vuex.Store({
       state.permissions = [];
     },
 
+    permissions: function(state) {
+      state.permissions = getPermissions();
+    },
+
     connected: function(state) {
       state.connected = true;
     },
@@ -139,10 +143,21 @@ var routes = [
     component: {
       template: '<div></div>',
       created: function() {
-        setCookie("authtok", "", -1);
-        setCookie("permissions", "", -1);
-        websocket.disconnect();
-        this.$store.commit('logout');
+        var self = this;
+        $.ajax({
+          url: '/logout',
+          method: 'POST',
+          headers: {
+            'Authorization': 'Bearer ' + getCookie("authtok"),
+          },
+        })
+        .always(function() {
+          setCookie("authtok", "", -1);
+          setCookie("permissions", "", -1);
+          setCookie("permissions_version", "", -1);
+          websocket.disconnect();
+          self.$store.commit('logout');
+        });
       }
     }
   },
@@ -345,6 +360,12 @@ var app = new Vue({
 
 });
 
+// the server refreshes the permissions cookie when the permissions changed
+$(document).ajaxComplete(function(event, xhr) {
+  if (xhr.getResponseHeader("X-Permissions-Changed"))
+    store.commit('permissions');
+});
+
 $(document).ready(function() {
   Vue.config.devtools = true;
 
@@ -27,13 +27,29 @@ var LoginComponent = {
 
     login: function() {
       var self = this;
+      var data = $(this.$el).serialize();
+
+      var post = function(data) {
+        return $.ajax({
+          url: '/login',
+          data: data,
+          method: 'POST',
+        })
+        .then(function(data) {
+          self.$store.commit('login');
+        });
+      };
+
+      // the nonce endpoint only exists when the login nonces are enabled
       $.ajax({
-        url: '/login',
-        data: $(this.$el).serialize(),
-        method: 'POST',
+        url: '/login/nonce',
+        method: 'GET',
+        global: false,
       })
-      .then(function(data) {
-        self.$store.commit('login');
+      .then(function(nonce) {
+        post(data + '&' + $.param({nonce: nonce.Nonce}));
+      }, function() {
+        post(data);
       });
     },
 